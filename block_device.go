@@ -20,3 +20,12 @@ type BlockDevice interface {
 	// See io.WriterAt for more information on this function.
 	WriteAt(p []byte, off int64) (n int, err error)
 }
+
+// A ReadOnlyDevice is a BlockDevice that can report that it refuses
+// writes. Filesystems opened on such a device are read-only.
+type ReadOnlyDevice interface {
+	BlockDevice
+
+	// ReadOnly returns true if WriteAt always fails.
+	ReadOnly() bool
+}
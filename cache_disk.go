@@ -0,0 +1,337 @@
+package ffs
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+)
+
+// CacheConfig is the configuration for a CacheDisk.
+type CacheConfig struct {
+	// BlockSize is the size in bytes of a single cache block. It should
+	// be the cluster size of the filesystem on the device so that a
+	// cluster maps onto exactly one block. Defaults to the sector size
+	// of the device. Must be a multiple of the sector size.
+	BlockSize int
+
+	// Blocks is the maximum number of blocks held in the cache.
+	// Defaults to 1024.
+	Blocks int
+
+	// ReadAhead is the number of blocks that are fetched beyond the
+	// requested one when sequential reads are detected. Defaults to 0,
+	// which disables read-ahead.
+	ReadAhead int
+}
+
+// CacheStats holds the hit/miss counters of a CacheDisk.
+type CacheStats struct {
+	Hits       uint64
+	Misses     uint64
+	ReadAheads uint64
+	Evictions  uint64
+	WriteBacks uint64
+}
+
+// A CacheDisk is a BlockDevice that wraps another BlockDevice with an
+// LRU block cache. Writes are held in the cache until Flush is called
+// or the block is evicted, so Flush (or Close) must be called before
+// the underlying device is used directly. A CacheDisk is safe for
+// concurrent use.
+type CacheDisk struct {
+	device    BlockDevice
+	blockSize int64
+	maxBlocks int
+	readAhead int
+
+	mu        sync.Mutex
+	blocks    map[int64]*list.Element
+	lru       *list.List
+	lastBlock int64
+	stats     CacheStats
+}
+
+// cacheBlock is a single block held by a CacheDisk.
+type cacheBlock struct {
+	index int64
+	data  []byte
+	dirty bool
+}
+
+var _ ReadOnlyDevice = (*CacheDisk)(nil)
+
+// NewCacheDisk creates a new CacheDisk in front of the given device.
+// A nil config uses the defaults.
+func NewCacheDisk(device BlockDevice, config *CacheConfig) (*CacheDisk, error) {
+	if config == nil {
+		config = &CacheConfig{}
+	}
+
+	blockSize := config.BlockSize
+	if blockSize == 0 {
+		blockSize = device.SectorSize()
+	}
+
+	if blockSize <= 0 || blockSize%device.SectorSize() != 0 {
+		return nil, errors.New("cache block size must be a multiple of the sector size")
+	}
+
+	maxBlocks := config.Blocks
+	if maxBlocks == 0 {
+		maxBlocks = 1024
+	}
+
+	if maxBlocks < 0 || config.ReadAhead < 0 {
+		return nil, errors.New("cache block count and read-ahead must not be negative")
+	}
+
+	return &CacheDisk{
+		device:    device,
+		blockSize: int64(blockSize),
+		maxBlocks: maxBlocks,
+		readAhead: config.ReadAhead,
+		blocks:    make(map[int64]*list.Element),
+		lru:       list.New(),
+		lastBlock: -1,
+	}, nil
+}
+
+// Close flushes all dirty blocks and closes the underlying device.
+func (c *CacheDisk) Close() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+
+	return c.device.Close()
+}
+
+func (c *CacheDisk) Len() int64 {
+	return c.device.Len()
+}
+
+func (c *CacheDisk) SectorSize() int {
+	return c.device.SectorSize()
+}
+
+// ReadOnly returns true if the underlying device refuses writes.
+func (c *CacheDisk) ReadOnly() bool {
+	if ro, ok := c.device.(ReadOnlyDevice); ok {
+		return ro.ReadOnly()
+	}
+
+	return false
+}
+
+func (c *CacheDisk) ReadAt(p []byte, off int64) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= c.device.Len() {
+			return n, io.EOF
+		}
+
+		index := pos / c.blockSize
+		block, err := c.block(index, true)
+		if err != nil {
+			return n, err
+		}
+
+		start := int(pos - index*c.blockSize)
+		nc := copy(p[n:], block.data[start:])
+		if nc == 0 {
+			return n, io.EOF
+		}
+
+		n += nc
+	}
+
+	return n, nil
+}
+
+func (c *CacheDisk) WriteAt(p []byte, off int64) (n int, err error) {
+	if c.ReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= c.device.Len() {
+			return n, io.ErrShortWrite
+		}
+
+		index := pos / c.blockSize
+		start := int(pos - index*c.blockSize)
+
+		// A write covering the whole block doesn't need the old data
+		whole := start == 0 && len(p)-n >= int(c.blockSize)
+		block, err := c.block(index, !whole)
+		if err != nil {
+			return n, err
+		}
+
+		nc := copy(block.data[start:], p[n:])
+		if nc == 0 {
+			return n, io.ErrShortWrite
+		}
+
+		block.dirty = true
+		n += nc
+	}
+
+	return n, nil
+}
+
+// Flush writes all dirty blocks to the underlying device.
+func (c *CacheDisk) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		if err := c.writeBack(e.Value.(*cacheBlock)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stats returns a snapshot of the cache counters.
+func (c *CacheDisk) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// block returns the cached block with the given index, loading it from
+// the device if necessary. If fill is false a missing block is not read
+// from the device because the caller is about to overwrite all of it.
+func (c *CacheDisk) block(index int64, fill bool) (*cacheBlock, error) {
+	sequential := index == c.lastBlock+1
+	c.lastBlock = index
+
+	if e, ok := c.blocks[index]; ok {
+		c.stats.Hits++
+		c.lru.MoveToFront(e)
+		return e.Value.(*cacheBlock), nil
+	}
+
+	c.stats.Misses++
+	count := int64(1)
+	if fill && sequential {
+		count += c.readAheadRun(index)
+	}
+
+	block, err := c.load(index, count, fill)
+	if err != nil && count > 1 {
+		// Read-ahead is only a hint, the real read will report the
+		// error if one of the blocks is ever requested.
+		block, err = c.load(index, 1, fill)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// readAheadRun returns the number of blocks following index that aren't
+// cached, up to the read-ahead limit and the end of the device.
+func (c *CacheDisk) readAheadRun(index int64) int64 {
+	run := int64(0)
+	for run < int64(c.readAhead) && run+1 < int64(c.maxBlocks) {
+		next := index + run + 1
+		if next*c.blockSize >= c.device.Len() {
+			break
+		}
+
+		if _, ok := c.blocks[next]; ok {
+			break
+		}
+
+		run++
+	}
+
+	return run
+}
+
+// load reads count blocks starting at index from the device with a
+// single read and inserts them into the cache, evicting the least
+// recently used blocks if the cache is full. It returns the block at
+// index, which is left the most recently used.
+func (c *CacheDisk) load(index, count int64, fill bool) (*cacheBlock, error) {
+	offset := index * c.blockSize
+	size := count * c.blockSize
+	if remain := c.device.Len() - offset; remain < size {
+		size = remain
+	}
+
+	data := make([]byte, size)
+	if fill {
+		if _, err := c.device.ReadAt(data, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	// Insert the read-ahead blocks first, the requested one goes in
+	// last so that it can't be evicted by them
+	var block *cacheBlock
+	for i := count - 1; i >= 0; i-- {
+		start := i * c.blockSize
+		end := min(start+c.blockSize, size)
+		b := &cacheBlock{
+			index: index + i,
+			data:  data[start:end:end],
+		}
+
+		for c.lru.Len() >= c.maxBlocks {
+			if err := c.evict(); err != nil {
+				return nil, err
+			}
+		}
+
+		c.blocks[b.index] = c.lru.PushFront(b)
+		if i > 0 {
+			c.stats.ReadAheads++
+		} else {
+			block = b
+		}
+	}
+
+	return block, nil
+}
+
+// evict removes the least recently used block, writing it back first
+// if it is dirty.
+func (c *CacheDisk) evict() error {
+	e := c.lru.Back()
+	block := e.Value.(*cacheBlock)
+	if err := c.writeBack(block); err != nil {
+		return err
+	}
+
+	c.lru.Remove(e)
+	delete(c.blocks, block.index)
+	c.stats.Evictions++
+	return nil
+}
+
+func (c *CacheDisk) writeBack(block *cacheBlock) error {
+	if !block.dirty {
+		return nil
+	}
+
+	if _, err := c.device.WriteAt(block.data, block.index*c.blockSize); err != nil {
+		return err
+	}
+
+	block.dirty = false
+	c.stats.WriteBacks++
+	return nil
+}
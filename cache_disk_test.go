@@ -0,0 +1,99 @@
+package ffs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rstms/ffs/internal/testdisk"
+)
+
+func TestCacheDiskImplementsBlockDevice(t *testing.T) {
+	var raw interface{}
+	raw = new(CacheDisk)
+	if _, ok := raw.(BlockDevice); !ok {
+		t.Fatal("CacheDisk should be a BlockDevice")
+	}
+}
+
+func TestCacheDisk_ReadAhead(t *testing.T) {
+	mem := testdisk.New(make([]byte, 64*1024))
+	for i := range mem.Data {
+		mem.Data[i] = byte(i / 2048)
+	}
+
+	cache, err := NewCacheDisk(mem, &CacheConfig{BlockSize: 2048, Blocks: 16, ReadAhead: 4})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Read the first 8 clusters in small pieces the way ClusterChain does
+	p := make([]byte, 512)
+	for off := int64(0); off < 8*2048; off += 512 {
+		if _, err := cache.ReadAt(p, off); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if p[0] != byte(off/2048) {
+			t.Fatalf("bad data at %d: %d", off, p[0])
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Misses != 2 {
+		t.Fatalf("expected 2 misses, got %+v", stats)
+	}
+	if stats.ReadAheads != 8 {
+		t.Fatalf("expected 8 read-ahead blocks, got %+v", stats)
+	}
+	// Each miss reads the block and the ones after it at once
+	if mem.Reads != 2 {
+		t.Fatalf("expected 2 device reads, got %d", mem.Reads)
+	}
+}
+
+func TestCacheDisk_WriteBack(t *testing.T) {
+	mem := testdisk.New(make([]byte, 16*1024))
+	cache, err := NewCacheDisk(mem, &CacheConfig{BlockSize: 1024, Blocks: 2})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data := bytes.Repeat([]byte{0xAB}, 1500)
+	if _, err := cache.WriteAt(data, 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if mem.Writes != 0 {
+		t.Fatal("write should be held in the cache")
+	}
+
+	// Reading back through the cache sees the new data
+	p := make([]byte, 1500)
+	if _, err := cache.ReadAt(p, 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(p, data) {
+		t.Fatal("cache returned stale data")
+	}
+
+	// Touching other blocks evicts and writes back the dirty ones
+	if _, err := cache.ReadAt(p, 8192); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if mem.Writes == 0 {
+		t.Fatal("evicted dirty block should have been written back")
+	}
+
+	if _, err := cache.WriteAt([]byte{1, 2, 3}, 4096); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := cache.Flush(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(mem.Data[100:1600], data) || !bytes.Equal(mem.Data[4096:4099], []byte{1, 2, 3}) {
+		t.Fatal("flushed data missing from the device")
+	}
+
+	stats := cache.Stats()
+	if stats.WriteBacks != 3 {
+		t.Fatalf("expected 3 write-backs, got %+v", stats)
+	}
+}
@@ -0,0 +1,285 @@
+package fat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+)
+
+// ClusterState is the state of a cluster according to its FAT entry.
+type ClusterState int
+
+const (
+	ClusterFree ClusterState = iota
+	ClusterUsed
+	ClusterEOF
+	ClusterReserved
+	ClusterBad
+)
+
+func (s ClusterState) String() string {
+	switch s {
+	case ClusterFree:
+		return "free"
+	case ClusterUsed:
+		return "used"
+	case ClusterEOF:
+		return "eof"
+	case ClusterReserved:
+		return "reserved"
+	case ClusterBad:
+		return "bad"
+	}
+
+	return fmt.Sprintf("ClusterState(%d)", int(s))
+}
+
+// MarshalText encodes the state by name, so that it reads well in JSON.
+func (s ClusterState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ClusterInfo describes a single cluster of the data region. Next is the
+// raw FAT entry, the following cluster for a used cluster. Path is the
+// file or directory whose chain holds the cluster; a used or EOF cluster
+// without one is leaked. When chains are cross-linked the cluster keeps
+// the first path found.
+type ClusterInfo struct {
+	Cluster uint32       `json:"cluster"`
+	State   ClusterState `json:"state"`
+	Next    uint32       `json:"next,omitempty"`
+	Path    string       `json:"path,omitempty"`
+}
+
+// Leaked returns true if the cluster is allocated but no file or
+// directory refers to it.
+func (c *ClusterInfo) Leaked() bool {
+	return (c.State == ClusterUsed || c.State == ClusterEOF) && c.Path == ""
+}
+
+// AllocationMap is the state and owner of every cluster of a volume,
+// starting with FirstCluster. It encodes to JSON with encoding/json and
+// to a compact text map with WriteText.
+type AllocationMap struct {
+	BytesPerCluster uint32        `json:"bytesPerCluster"`
+	Clusters        []ClusterInfo `json:"clusters"`
+}
+
+// AllocationMap returns the allocation map of the filesystem. Broken
+// chains are followed as far as they go rather than reported as errors,
+// since the map is meant for looking at damaged volumes too.
+func (f *FileSystem) AllocationMap() (*AllocationMap, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	limit := f.fat.clusterLimit()
+	owners := make([]string, limit)
+	if !f.rootDir.fat16Root {
+		f.fat.claim(owners, f.rootDir.startCluster, "/")
+	}
+
+	if err := f.claimDir(owners, f.root(), "/"); err != nil {
+		return nil, Fatal(err)
+	}
+
+	result := &AllocationMap{
+		BytesPerCluster: f.bs.BytesPerCluster(),
+		Clusters:        make([]ClusterInfo, 0, limit-FirstCluster),
+	}
+
+	for cluster := uint32(FirstCluster); cluster < limit; cluster++ {
+		next := f.fat.entries[cluster]
+		info := ClusterInfo{
+			Cluster: cluster,
+			State:   f.fat.clusterState(next),
+			Path:    owners[cluster],
+		}
+		if info.State == ClusterUsed {
+			info.Next = next
+		}
+
+		result.Clusters = append(result.Clusters, info)
+	}
+
+	return result, nil
+}
+
+// claimDir records the entries of the directory, and of every directory
+// below it, as the owners of their clusters.
+func (f *FileSystem) claimDir(owners []string, dir *Directory, name string) error {
+	for _, entry := range dir.entries() {
+		if entry.name == "." || entry.name == ".." {
+			continue
+		}
+
+		entryName := path.Join(name, entry.name)
+		cluster := entry.entry.cluster
+		if cluster < FirstCluster || cluster >= uint32(len(owners)) || owners[cluster] != "" {
+			// Empty, broken or already claimed; don't descend
+			continue
+		}
+
+		f.fat.claim(owners, cluster, entryName)
+		if !entry.isDir() {
+			continue
+		}
+
+		subdir, err := entry.openDir()
+		if err != nil {
+			return Fatal(err)
+		}
+
+		if err := f.claimDir(owners, subdir, entryName); err != nil {
+			return Fatal(err)
+		}
+	}
+
+	return nil
+}
+
+// claim follows the chain from start, setting name as the owner of its
+// clusters. It stops at the end of the chain, at a cluster outside the
+// data region or at one that is already owned.
+func (f *FAT) claim(owners []string, start uint32, name string) {
+	cluster := start
+	for cluster >= FirstCluster && cluster < uint32(len(owners)) && owners[cluster] == "" {
+		owners[cluster] = name
+		if f.clusterState(f.entries[cluster]) != ClusterUsed {
+			return
+		}
+
+		cluster = f.entries[cluster]
+	}
+}
+
+// clusterState returns the state of a cluster with the given FAT entry.
+func (f *FAT) clusterState(entry uint32) ClusterState {
+	mask := f.entryMask()
+	switch {
+	case entry == 0:
+		return ClusterFree
+	case entry == 1:
+		return ClusterReserved
+	case f.isEofCluster(entry):
+		return ClusterEOF
+	case entry == 0x0FFFFFF7&mask:
+		return ClusterBad
+	case entry >= 0x0FFFFFF0&mask:
+		return ClusterReserved
+	}
+
+	return ClusterUsed
+}
+
+// Leaked returns the clusters that are allocated but not referred to by
+// any file or directory.
+func (m *AllocationMap) Leaked() []uint32 {
+	result := []uint32{}
+	for _, info := range m.Clusters {
+		if info.Leaked() {
+			result = append(result, info.Cluster)
+		}
+	}
+
+	return result
+}
+
+const (
+	mapWidth = 64
+
+	ansiReset = "\x1b[0m"
+	ansiLeak  = "\x1b[1;37;41m"
+	ansiBad   = "\x1b[1;31m"
+	ansiDim   = "\x1b[2m"
+)
+
+// ansiOwners are the colours given to owners in turn, so that the
+// fragments of one file stand out from those of its neighbours.
+var ansiOwners = []string{
+	"\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m",
+	"\x1b[92m", "\x1b[93m", "\x1b[94m", "\x1b[95m", "\x1b[96m",
+}
+
+// WriteText writes the map with one character per cluster and 64
+// clusters per line, each line starting with its first cluster:
+//
+//	.  free        #  used      $  end of chain
+//	R  reserved    B  bad       !  leaked
+//
+// With ansi set the characters are coloured: each owner in turn gets its
+// own colour, and leaked and bad clusters are highlighted.
+func (m *AllocationMap) WriteText(w io.Writer, ansi bool) error {
+	out := bufio.NewWriter(w)
+	colours := map[string]string{}
+	current := ""
+	for i, info := range m.Clusters {
+		if i%mapWidth == 0 {
+			if i > 0 {
+				fmt.Fprintln(out)
+			}
+			if ansi && current != "" {
+				out.WriteString(ansiReset)
+				current = ""
+			}
+			fmt.Fprintf(out, "%8d ", info.Cluster)
+		}
+
+		if ansi {
+			colour := clusterColour(&info, colours)
+			if colour != current {
+				out.WriteString(ansiReset + colour)
+				current = colour
+			}
+		}
+
+		out.WriteByte(clusterChar(&info))
+	}
+
+	if ansi && current != "" {
+		out.WriteString(ansiReset)
+	}
+	fmt.Fprintln(out)
+
+	if err := out.Flush(); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+func clusterChar(info *ClusterInfo) byte {
+	switch {
+	case info.Leaked():
+		return '!'
+	case info.State == ClusterFree:
+		return '.'
+	case info.State == ClusterUsed:
+		return '#'
+	case info.State == ClusterEOF:
+		return '$'
+	case info.State == ClusterBad:
+		return 'B'
+	}
+
+	return 'R'
+}
+
+func clusterColour(info *ClusterInfo, colours map[string]string) string {
+	switch {
+	case info.Leaked():
+		return ansiLeak
+	case info.State == ClusterBad:
+		return ansiBad
+	case info.Path == "":
+		return ansiDim
+	}
+
+	colour, ok := colours[info.Path]
+	if !ok {
+		colour = ansiOwners[len(colours)%len(ansiOwners)]
+		colours[info.Path] = colour
+	}
+
+	return colour
+}
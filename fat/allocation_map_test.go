@@ -0,0 +1,90 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFileSystem_AllocationMap(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	if err := fatFs.MkdirAll("boot/grub"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	file, err := fatFs.Create("boot/grub/grub.cfg")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := file.Write(make([]byte, 1500)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A leaked chain and a bad cluster
+	leaked, err := fatFs.fat.AllocChain()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fatFs.fat.entries[100] = 0xFF7
+
+	m, err := fatFs.AllocationMap()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(m.Clusters) != int(fatFs.bs.ClusterCount()) || m.Clusters[0].Cluster != FirstCluster {
+		t.Fatalf("bad cluster range: %d clusters", len(m.Clusters))
+	}
+
+	owned := map[string]int{}
+	for _, info := range m.Clusters {
+		if info.Path != "" {
+			owned[info.Path]++
+		}
+	}
+	if owned["/boot"] != 1 || owned["/boot/grub"] != 1 || owned["/boot/grub/grub.cfg"] != 3 {
+		t.Fatalf("bad owners %v", owned)
+	}
+
+	if got := m.Leaked(); len(got) != 1 || got[0] != leaked {
+		t.Fatalf("expected cluster %d leaked, got %v", leaked, got)
+	}
+	bad := m.Clusters[100-FirstCluster]
+	if bad.State != ClusterBad || bad.Path != "" {
+		t.Fatalf("bad cluster %+v", bad)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Contains(data, []byte(`{"cluster":100,"state":"bad"}`)) {
+		t.Fatalf("bad cluster missing from JSON: %s", data[:200])
+	}
+	if !bytes.Contains(data, []byte(`"state":"eof","path":"/boot/grub/grub.cfg"`)) {
+		t.Fatal("end of grub.cfg missing from JSON")
+	}
+
+	var text bytes.Buffer
+	if err := m.WriteText(&text, false); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n")
+	if len(lines) != (len(m.Clusters)+mapWidth-1)/mapWidth {
+		t.Fatalf("bad line count %d", len(lines))
+	}
+	if !strings.HasPrefix(lines[0], "       2 $$##$!....") {
+		t.Fatalf("bad first line %q", lines[0])
+	}
+	if lines[1][9+100-FirstCluster-mapWidth] != 'B' {
+		t.Fatalf("bad second line %q", lines[1])
+	}
+
+	var coloured bytes.Buffer
+	if err := m.WriteText(&coloured, true); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(coloured.String(), ansiLeak+"!") {
+		t.Fatal("leaked cluster not highlighted")
+	}
+}
@@ -0,0 +1,233 @@
+package fat
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/rstms/ffs"
+)
+
+// scanClusters is the number of clusters read at once by a surface
+// scan. A failed read is retried one cluster at a time.
+const scanClusters = 64
+
+// BadBlock is a range of the volume that can't be used, in bytes from
+// the start of the volume. Every cluster it touches is marked bad.
+type BadBlock struct {
+	Offset int64
+	Length int64
+}
+
+// ReadBadBlocks reads a list of bad blocks in the format written by
+// badblocks(8): one block number per line, counted in blocks of the
+// given size. Empty lines and lines starting with # are skipped.
+func ReadBadBlocks(r io.Reader, blockSize int64) ([]BadBlock, error) {
+	if blockSize <= 0 {
+		return nil, Fatalf("bad block size %d", blockSize)
+	}
+
+	result := []BadBlock{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		block, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || block < 0 {
+			return nil, Fatalf("line %d: bad block number %q", line, text)
+		}
+
+		result = append(result, BadBlock{Offset: block * blockSize, Length: blockSize})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, Fatal(err)
+	}
+
+	return result, nil
+}
+
+// ScanSurface reads every sector of the volume and returns the clusters
+// of the data region that can't be read. It fails if the volume extends
+// past the end of the device, or with ErrBadSystemArea if the sectors in
+// front of the data region can't be read.
+func ScanSurface(device ffs.BlockDevice, bs *BootSectorCommon) ([]uint32, error) {
+	bpc := int64(bs.BytesPerCluster())
+	limit := bs.ClusterCount() + FirstCluster
+	if end := int64(bs.ClusterOffset(int(limit))); end > device.Len() {
+		return nil, Fatalf("volume of %d bytes extends past the end of the device: %w", end, ErrCorrupt)
+	}
+
+	system := make([]byte, bs.DataOffset())
+	if _, err := device.ReadAt(system, 0); err != nil {
+		return nil, Fatalf("%w: %v", ErrBadSystemArea, err)
+	}
+
+	data := make([]byte, bpc*scanClusters)
+	result := []uint32{}
+	for start := uint32(FirstCluster); start < limit; start += scanClusters {
+		count := min(limit-start, scanClusters)
+		offset := int64(bs.ClusterOffset(int(start)))
+		if _, err := device.ReadAt(data[:bpc*int64(count)], offset); err == nil {
+			continue
+		}
+
+		for cluster := start; cluster < start+count; cluster++ {
+			if _, err := device.ReadAt(data[:bpc], int64(bs.ClusterOffset(int(cluster)))); err != nil {
+				result = append(result, cluster)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// badBlockClusters returns the clusters of the data region touched by
+// the bad blocks. Blocks past the end of the volume are ignored, blocks
+// in front of the data region fail with ErrBadSystemArea.
+func badBlockClusters(bs *BootSectorCommon, blocks []BadBlock) ([]uint32, error) {
+	bpc := int64(bs.BytesPerCluster())
+	dataOffset := int64(bs.DataOffset())
+	limit := int64(bs.ClusterCount()) + FirstCluster
+
+	seen := map[uint32]bool{}
+	result := []uint32{}
+	for _, block := range blocks {
+		if block.Length <= 0 {
+			continue
+		}
+
+		if block.Offset < dataOffset {
+			return nil, Fatalf("block at byte %d: %w", block.Offset, ErrBadSystemArea)
+		}
+
+		first := (block.Offset-dataOffset)/bpc + FirstCluster
+		last := (block.Offset+block.Length-1-dataOffset)/bpc + FirstCluster
+		for cluster := first; cluster <= last && cluster < limit; cluster++ {
+			if !seen[uint32(cluster)] {
+				seen[uint32(cluster)] = true
+				result = append(result, uint32(cluster))
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// badValue returns the FAT entry of a bad cluster.
+func (f *FAT) badValue() uint32 {
+	return 0x0FFFFFF7 & f.entryMask()
+}
+
+// markBad marks the free clusters among the given ones as bad and
+// returns the ones it left alone because they are in use.
+func (f *FAT) markBad(clusters []uint32) ([]uint32, error) {
+	limit := f.clusterLimit()
+	inUse := []uint32{}
+	for _, cluster := range clusters {
+		if cluster < FirstCluster || cluster >= limit {
+			return nil, Fatalf("cluster %d outside the data region", cluster)
+		}
+
+		switch f.entries[cluster] {
+		case 0, f.badValue():
+			f.entries[cluster] = f.badValue()
+		default:
+			inUse = append(inUse, cluster)
+		}
+	}
+
+	return inUse, nil
+}
+
+// BadClusters returns the clusters marked bad in this copy of the FAT,
+// in ascending order. The slice is newly allocated on every call. The
+// caller must keep the FAT from changing while it runs.
+func (f *FAT) BadClusters() []uint32 {
+	result := []uint32{}
+	for cluster := uint32(FirstCluster); cluster < f.clusterLimit(); cluster++ {
+		if f.entries[cluster] == f.badValue() {
+			result = append(result, cluster)
+		}
+	}
+
+	return result
+}
+
+// BadClusters is FAT.BadClusters for the filesystem, taken under its
+// read lock so that it doesn't race with writers. The ascending list is
+// a copy the caller may keep and modify.
+func (f *FileSystem) BadClusters() []uint32 {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.fat.BadClusters()
+}
+
+// MarkBadBlocks marks the free clusters touched by the bad blocks as
+// bad, so that they are never allocated. Clusters that are in use are
+// left alone and returned, the files holding them need to be moved by
+// the caller. Blocks in front of the data region fail with
+// ErrBadSystemArea.
+func (f *FileSystem) MarkBadBlocks(blocks []BadBlock) ([]uint32, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("mark bad", ""); err != nil {
+		return nil, Fatal(err)
+	}
+
+	bad, err := badBlockClusters(f.bs, blocks)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	inUse, err := f.markBad(bad)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return inUse, nil
+}
+
+// ScanSurface reads every cluster of the volume and marks the free ones
+// that can't be read as bad. It returns the unreadable clusters that
+// are in use, like MarkBadBlocks, and fails like the ScanSurface
+// function.
+func (f *FileSystem) ScanSurface() ([]uint32, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("mark bad", ""); err != nil {
+		return nil, Fatal(err)
+	}
+
+	unreadable, err := ScanSurface(f.device, f.bs)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	inUse, err := f.markBad(unreadable)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return inUse, nil
+}
+
+func (f *FileSystem) markBad(clusters []uint32) ([]uint32, error) {
+	inUse, err := f.fat.markBad(clusters)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if err := f.fat.WriteToDevice(f.device); err != nil {
+		return nil, Fatal(err)
+	}
+
+	return inUse, nil
+}
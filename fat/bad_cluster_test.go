@@ -0,0 +1,202 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/rstms/ffs"
+	"github.com/rstms/ffs/internal/testdisk"
+)
+
+// faultyDevice fails reads that touch one of its bad byte ranges, and
+// writes that touch one of its bad write ranges.
+type faultyDevice struct {
+	ffs.BlockDevice
+	bad       []BadBlock
+	badWrites []BadBlock
+}
+
+func (d *faultyDevice) ReadAt(p []byte, off int64) (int, error) {
+	for _, b := range d.bad {
+		if off < b.Offset+b.Length && b.Offset < off+int64(len(p)) {
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+
+	return d.BlockDevice.ReadAt(p, off)
+}
+
+func (d *faultyDevice) WriteAt(p []byte, off int64) (int, error) {
+	for _, b := range d.badWrites {
+		if off < b.Offset+b.Length && b.Offset < off+int64(len(p)) {
+			return 0, io.ErrShortWrite
+		}
+	}
+
+	return d.BlockDevice.WriteAt(p, off)
+}
+
+func TestReadBadBlocks(t *testing.T) {
+	blocks, err := ReadBadBlocks(strings.NewReader("# badblocks -b 4096\n12\n\n 40 \n"), 4096)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(blocks) != 2 || blocks[0] != (BadBlock{12 * 4096, 4096}) || blocks[1] != (BadBlock{40 * 4096, 4096}) {
+		t.Fatalf("bad blocks %v", blocks)
+	}
+
+	if _, err := ReadBadBlocks(strings.NewReader("12\nx\n"), 4096); err == nil {
+		t.Fatal("expected error for a bad line")
+	}
+}
+
+func TestFormatSuperFloppy_BadBlocks(t *testing.T) {
+	device := testdisk.New(make([]byte, 1440*1024))
+
+	// Data starts at sector 33 of a 1.44M floppy: cluster 2 + n is
+	// sector 31 + n. The first block touches sectors 42 and 43.
+	config := &SuperFloppyConfig{
+		FATType:   FAT12,
+		BadBlocks: []BadBlock{{42*512 + 100, 512}},
+	}
+	faulty := &faultyDevice{BlockDevice: device, bad: []BadBlock{{60 * 512, 1}}}
+	config.ScanSurface = true
+	if err := FormatSuperFloppy(faulty, config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fatFs, err := New(faulty)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	bad := fatFs.BadClusters()
+	if len(bad) != 3 || bad[0] != 11 || bad[1] != 12 || bad[2] != 29 {
+		t.Fatalf("bad clusters %v", bad)
+	}
+
+	info, err := fatFs.Info()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if got, ok := info["BadClusters"].([]uint32); !ok || len(got) != 3 {
+		t.Fatalf("bad clusters missing from info: %v", info["BadClusters"])
+	}
+
+	// Bad clusters are never allocated
+	file, err := fatFs.Create("big.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := file.Write(make([]byte, 40*512)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	extents, err := fatFs.FileExtents("big.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(extents) != 3 || extents[0].Cluster != 2 || extents[1].Cluster != 13 || extents[2].Cluster != 30 {
+		t.Fatalf("bad clusters allocated: %+v", extents)
+	}
+}
+
+func TestFormatSuperFloppy_BadSystemArea(t *testing.T) {
+	device := testdisk.New(make([]byte, 1440*1024))
+	memory := make([]byte, 1440*1024)
+	if _, err := device.ReadAt(memory, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The boot sector, a FAT and the root directory, which ends at
+	// sector 33 of a 1.44M floppy
+	for _, block := range []BadBlock{{1, 10}, {5 * 512, 512}, {32 * 512, 512}} {
+		config := &SuperFloppyConfig{FATType: FAT12, BadBlocks: []BadBlock{block}}
+		if err := FormatSuperFloppy(device, config); !errors.Is(err, ErrBadSystemArea) {
+			t.Fatalf("%v: expected ErrBadSystemArea, got %v", block, err)
+		}
+
+		faulty := &faultyDevice{BlockDevice: device, bad: []BadBlock{block}}
+		config = &SuperFloppyConfig{FATType: FAT12, ScanSurface: true}
+		if err := FormatSuperFloppy(faulty, config); !errors.Is(err, ErrBadSystemArea) {
+			t.Fatalf("%v: expected ErrBadSystemArea from the scan, got %v", block, err)
+		}
+	}
+
+	// Nothing was written
+	after := make([]byte, len(memory))
+	if _, err := device.ReadAt(after, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(after, memory) {
+		t.Fatal("failed format wrote to the device")
+	}
+
+	_, fatFs := newTestFloppy(t)
+	if _, err := fatFs.MarkBadBlocks([]BadBlock{{0, 512}}); !errors.Is(err, ErrBadSystemArea) {
+		t.Fatalf("expected ErrBadSystemArea, got %v", err)
+	}
+}
+
+func TestScanSurface_DeviceTooSmall(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	small := testdisk.New(make([]byte, 1024*1024))
+	if _, err := ScanSurface(small, fatFs.bs); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	if _, err := ScanSurface(device, fatFs.bs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestFileSystem_ScanSurface(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	file, err := fatFs.Create("a.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := file.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// a.txt is in cluster 2, sector 33; cluster 102 is free
+	faulty := &faultyDevice{BlockDevice: device, bad: []BadBlock{{33 * 512, 512}, {133 * 512, 512}}}
+	fatFs, err = New(faulty)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	inUse, err := fatFs.ScanSurface()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(inUse) != 1 || inUse[0] != 2 {
+		t.Fatalf("expected cluster 2 in use, got %v", inUse)
+	}
+	if bad := fatFs.BadClusters(); len(bad) != 1 || bad[0] != 102 {
+		t.Fatalf("bad clusters %v", bad)
+	}
+
+	inUse, err = fatFs.MarkBadBlocks([]BadBlock{{34 * 512, 1024}})
+	if err != nil || len(inUse) != 0 {
+		t.Fatalf("expected nothing in use, got %v: %v", inUse, err)
+	}
+	if bad := fatFs.BadClusters(); len(bad) != 3 {
+		t.Fatalf("bad clusters %v", bad)
+	}
+
+	// The marks survive reopening the filesystem
+	fatFs, err = NewReadOnly(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if bad := fatFs.BadClusters(); len(bad) != 3 {
+		t.Fatalf("bad clusters after reopening %v", bad)
+	}
+	if _, err := fatFs.ScanSurface(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
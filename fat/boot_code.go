@@ -0,0 +1,76 @@
+package fat
+
+// The boot code follows the BIOS parameter block and runs up to the
+// boot sector signature.
+const (
+	bootCodeOffsetFAT16 = 62
+	bootCodeOffsetFAT32 = 90
+	bootCodeEnd         = 510
+)
+
+// BootCode is the code in the boot sector that a BIOS runs to boot from
+// the volume.
+type BootCode struct {
+	// BS_jmpBoot, the jump over the BIOS parameter block. If zero, a
+	// jump to the start of Code is used.
+	Jump [3]byte
+
+	// The boot code, at most BootCodeSize bytes. It is loaded directly
+	// after the BIOS parameter block.
+	Code []byte
+}
+
+// bootCodeOffset returns the offset of the boot code in the boot sector.
+func bootCodeOffset(fatType FATType) int {
+	if fatType == FAT32 {
+		return bootCodeOffsetFAT32
+	}
+
+	return bootCodeOffsetFAT16
+}
+
+// BootCodeSize returns the number of bytes of boot code that fit in the
+// boot sector of the given FAT type.
+func BootCodeSize(fatType FATType) int {
+	return bootCodeEnd - bootCodeOffset(fatType)
+}
+
+// decodeBootCode returns the jump and the whole boot code area of the
+// boot sector.
+func decodeBootCode(sector []byte, fatType FATType) *BootCode {
+	result := &BootCode{
+		Code: make([]byte, BootCodeSize(fatType)),
+	}
+
+	copy(result.Jump[:], sector[0:3])
+	copy(result.Code, sector[bootCodeOffset(fatType):bootCodeEnd])
+	return result
+}
+
+// put writes the jump and the boot code into the boot sector, leaving
+// the BIOS parameter block alone. The rest of the boot code area is
+// zeroed. A nil BootCode gives a jump to an empty boot code area.
+func (b *BootCode) put(sector []byte, offset int) error {
+	jump := [3]byte{0xEB, byte(offset - 2), 0x90}
+	var code []byte
+	if b != nil {
+		if b.Jump != [3]byte{} {
+			jump = b.Jump
+		}
+		code = b.Code
+	}
+
+	// A short jump followed by a NOP or a near jump
+	if !(jump[0] == 0xEB && jump[2] == 0x90) && jump[0] != 0xE9 {
+		return Fatalf("invalid boot jump % x", jump)
+	}
+
+	if len(code) > bootCodeEnd-offset {
+		return Fatalf("boot code of %d bytes larger than %d", len(code), bootCodeEnd-offset)
+	}
+
+	copy(sector[0:3], jump[:])
+	n := copy(sector[offset:bootCodeEnd], code)
+	clear(sector[offset+n : bootCodeEnd])
+	return nil
+}
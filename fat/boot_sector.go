@@ -25,6 +25,40 @@ type BootSectorCommon struct {
 	SectorsPerFat       uint32
 	SectorsPerTrack     uint16
 	NumHeads            uint16
+	HiddenSectors       uint32
+}
+
+// The FAT type of a volume is determined by its count of data clusters
+// alone. These are the largest counts of each type.
+const (
+	MaxClustersFAT12 = 4084
+	MaxClustersFAT16 = 65524
+	MaxClustersFAT32 = 0x0FFFFFF5
+)
+
+// Drivers disagree on the type of volumes with a cluster count close to
+// the FAT12/FAT16 and FAT16/FAT32 limits, so new filesystems keep this
+// many clusters away from them.
+const clusterCountMargin = 16
+
+// The value of BS_BootSig when BS_VolID, BS_VolLab and BS_FilSysType
+// follow it. Some old formatters write 0x28 and only BS_VolID.
+const (
+	extendedBootSignature    = 0x29
+	extendedBootSignatureOld = 0x28
+)
+
+// bootSignatureOffset returns the offset of BS_BootSig, which is
+// followed by BS_VolID and BS_VolLab.
+func bootSignatureOffset(fatType FATType) (int, error) {
+	switch fatType {
+	case FAT12, FAT16:
+		return 38, nil
+	case FAT32:
+		return 66, nil
+	}
+
+	return 0, Fatalf("unexpected FATType: %d", fatType)
 }
 
 func DecodeVolumeLabel(device ffs.BlockDevice, fatType FATType) (string, error) {
@@ -32,15 +66,11 @@ func DecodeVolumeLabel(device ffs.BlockDevice, fatType FATType) (string, error)
 	if _, err := device.ReadAt(sector[:], 0); err != nil {
 		return "", Fatal(err)
 	}
-	var offset int
-	switch fatType {
-	case FAT12, FAT16:
-		offset = 43
-	case FAT32:
-		offset = 71
-	default:
-		return "", Fatalf("unexpected FATType: %d", fatType)
+	offset, err := bootSignatureOffset(fatType)
+	if err != nil {
+		return "", Fatal(err)
 	}
+	offset += 5
 	label := string(sector[offset : offset+11])
 	return label, nil
 }
@@ -54,7 +84,7 @@ func DecodeBootSector(device ffs.BlockDevice) (*BootSectorCommon, error) {
 	}
 
 	if sector[510] != 0x55 || sector[511] != 0xAA {
-		return nil, Fatalf("corrupt boot sector signature")
+		return nil, Fatalf("invalid boot sector signature: %w", ErrCorrupt)
 	}
 
 	result := new(BootSectorCommon)
@@ -86,6 +116,9 @@ func DecodeBootSector(device ffs.BlockDevice) (*BootSectorCommon, error) {
 	// BPB_NumHeads
 	result.NumHeads = binary.LittleEndian.Uint16(sector[26:28])
 
+	// BPB_HiddSec
+	result.HiddenSectors = binary.LittleEndian.Uint32(sector[28:32])
+
 	// BPB_TotSec16 / BPB_TotSec32
 	result.TotalSectors = uint32(binary.LittleEndian.Uint16(sector[19:21]))
 	if result.TotalSectors == 0 {
@@ -98,9 +131,69 @@ func DecodeBootSector(device ffs.BlockDevice) (*BootSectorCommon, error) {
 		result.SectorsPerFat = binary.LittleEndian.Uint32(sector[36:40])
 	}
 
+	if err := result.validate(); err != nil {
+		return nil, Fatal(err)
+	}
+
 	return result, nil
 }
 
+// validate checks the fields that the rest of the package divides by or
+// uses to size buffers, so that a corrupt boot sector is reported as
+// ErrCorrupt instead of causing a panic further down.
+func (b *BootSectorCommon) validate() error {
+	switch b.BytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return Fatalf("invalid bytes per sector %d: %w", b.BytesPerSector, ErrCorrupt)
+	}
+
+	if b.SectorsPerCluster == 0 || b.SectorsPerCluster&(b.SectorsPerCluster-1) != 0 {
+		return Fatalf("invalid sectors per cluster %d: %w", b.SectorsPerCluster, ErrCorrupt)
+	}
+
+	if b.ReservedSectorCount == 0 {
+		return Fatalf("no reserved sectors: %w", ErrCorrupt)
+	}
+
+	if b.NumFATs == 0 || b.SectorsPerFat == 0 {
+		return Fatalf("no FAT: %w", ErrCorrupt)
+	}
+
+	if b.metadataSectors() >= uint64(b.TotalSectors) {
+		return Fatalf("no data region in %d sectors: %w", b.TotalSectors, ErrCorrupt)
+	}
+
+	clusters := uint64(b.ClusterCount())
+	if clusters > MaxClustersFAT32 {
+		return Fatalf("%d clusters: %w", clusters, ErrCorrupt)
+	}
+
+	// Only FAT12/16 have a fixed root directory
+	if (b.FATType() == FAT32) != (b.RootEntryCount == 0) {
+		return Fatalf("%d root entries on %s volume: %w", b.RootEntryCount, b.FATType(), ErrCorrupt)
+	}
+
+	entries, err := FATEntryCount(b)
+	if err != nil {
+		return Fatal(err)
+	}
+
+	if uint64(entries) < clusters+FirstCluster {
+		return Fatalf("FAT of %d entries too small for %d clusters: %w", entries, clusters, ErrCorrupt)
+	}
+
+	return nil
+}
+
+// metadataSectors returns the number of sectors in front of the data
+// region: the reserved sectors, the FATs and the FAT12/16 root directory.
+func (b *BootSectorCommon) metadataSectors() uint64 {
+	bps := uint64(b.BytesPerSector)
+	rootDirSectors := (uint64(b.RootEntryCount)*DirectoryEntrySize + bps - 1) / bps
+	return uint64(b.ReservedSectorCount) + uint64(b.NumFATs)*uint64(b.SectorsPerFat) + rootDirSectors
+}
+
 func (b *BootSectorCommon) Bytes() ([]byte, error) {
 	var sector [512]byte
 
@@ -146,8 +239,8 @@ func (b *BootSectorCommon) Bytes() ([]byte, error) {
 	// BPB_Numheads
 	binary.LittleEndian.PutUint16(sector[26:28], b.NumHeads)
 
-	// BPB_Hiddsec
-	// sector[28:32] - it is always set to 0 because we don't partition drives yet.
+	// BPB_HiddSec
+	binary.LittleEndian.PutUint32(sector[28:32], b.HiddenSectors)
 
 	// Important signature of every FAT boot sector
 	sector[510] = 0x55
@@ -172,32 +265,35 @@ func (b *BootSectorCommon) ClusterOffset(n int) uint32 {
 // DataOffset returns the offset of the data section of the disk.
 func (b *BootSectorCommon) DataOffset() uint32 {
 	offset := uint32(b.RootDirOffset())
-	offset += uint32(b.RootEntryCount * DirectoryEntrySize)
+	offset += uint32(b.RootEntryCount) * DirectoryEntrySize
 	return offset
 }
 
 // FATOffset returns the offset in bytes for the given index of the FAT
 func (b *BootSectorCommon) FATOffset(n int) int {
-	offset := uint32(b.ReservedSectorCount * b.BytesPerSector)
+	offset := uint32(b.ReservedSectorCount) * uint32(b.BytesPerSector)
 	offset += b.SectorsPerFat * uint32(b.BytesPerSector) * uint32(n)
 	return int(offset)
 }
 
+// ClusterCount returns the number of data clusters on the volume.
+func (b *BootSectorCommon) ClusterCount() uint32 {
+	meta := b.metadataSectors()
+	if b.SectorsPerCluster == 0 || meta >= uint64(b.TotalSectors) {
+		return 0
+	}
+
+	return uint32((uint64(b.TotalSectors) - meta) / uint64(b.SectorsPerCluster))
+}
+
 // Calculates the FAT type that this boot sector represents.
 func (b *BootSectorCommon) FATType() FATType {
-	var rootDirSectors uint32
-	rootDirSectors = (uint32(b.RootEntryCount) * 32) + (uint32(b.BytesPerSector) - 1)
-	rootDirSectors /= uint32(b.BytesPerSector)
-	dataSectors := b.SectorsPerFat * uint32(b.NumFATs)
-	dataSectors += uint32(b.ReservedSectorCount)
-	dataSectors += rootDirSectors
-	dataSectors = b.TotalSectors - dataSectors
-	countClusters := dataSectors / uint32(b.SectorsPerCluster)
+	countClusters := b.ClusterCount()
 
 	switch {
-	case countClusters < 4085:
+	case countClusters <= MaxClustersFAT12:
 		return FAT12
-	case countClusters < 65525:
+	case countClusters <= MaxClustersFAT16:
 		return FAT16
 	default:
 		return FAT32
@@ -224,6 +320,7 @@ type BootSectorFat16 struct {
 	VolumeID            uint32
 	VolumeLabel         string
 	FileSystemTypeLabel string
+	BootCode            *BootCode
 }
 
 func (b *BootSectorFat16) Bytes() ([]byte, error) {
@@ -232,6 +329,11 @@ func (b *BootSectorFat16) Bytes() ([]byte, error) {
 		return nil, Fatal(err)
 	}
 
+	// BS_jmpBoot and the boot code
+	if err := b.BootCode.put(sector, bootCodeOffsetFAT16); err != nil {
+		return nil, Fatal(err)
+	}
+
 	// BPB_TotSec16 AND BPB_TotSec32
 	if b.TotalSectors < 0x10000 {
 		binary.LittleEndian.PutUint16(sector[19:21], uint16(b.TotalSectors))
@@ -255,18 +357,12 @@ func (b *BootSectorFat16) Bytes() ([]byte, error) {
 	// BS_VolID
 	binary.LittleEndian.PutUint32(sector[39:43], b.VolumeID)
 
-	// BS_VolLab
+	// BS_VolLab, already in OEM bytes
 	if len(b.VolumeLabel) > 11 {
 		return nil, Fatalf("VolumeLabel must be 11 bytes or less")
 	}
 
-	for i, r := range b.VolumeLabel {
-		if r > unicode.MaxASCII {
-			return nil, Fatalf("%#U in VolumeLabel not a valid ASCII char. Must be ASCII.", r)
-		}
-
-		sector[43+i] = byte(r)
-	}
+	copy(sector[43:54], b.VolumeLabel)
 
 	// BS_FilSysType
 	if len(b.FileSystemTypeLabel) > 8 {
@@ -294,6 +390,7 @@ type BootSectorFat32 struct {
 	VolumeID            uint32
 	VolumeLabel         string
 	FileSystemTypeLabel string
+	BootCode            *BootCode
 }
 
 func (b *BootSectorFat32) Bytes() ([]byte, error) {
@@ -302,6 +399,11 @@ func (b *BootSectorFat32) Bytes() ([]byte, error) {
 		return nil, Fatal(err)
 	}
 
+	// BS_jmpBoot and the boot code
+	if err := b.BootCode.put(sector, bootCodeOffsetFAT32); err != nil {
+		return nil, Fatal(err)
+	}
+
 	// BPB_RootEntCount - must be 0
 	sector[17] = 0
 	sector[18] = 0
@@ -334,18 +436,12 @@ func (b *BootSectorFat32) Bytes() ([]byte, error) {
 	// BS_VolID
 	binary.LittleEndian.PutUint32(sector[67:71], b.VolumeID)
 
-	// BS_VolLab
+	// BS_VolLab, already in OEM bytes
 	if len(b.VolumeLabel) > 11 {
 		return nil, Fatalf("VolumeLabel must be 11 bytes or less")
 	}
 
-	for i, r := range b.VolumeLabel {
-		if r > unicode.MaxASCII {
-			return nil, Fatalf("%#U in VolumeLabel not a valid ASCII char. Must be ASCII.", r)
-		}
-
-		sector[71+i] = byte(r)
-	}
+	copy(sector[71:82], b.VolumeLabel)
 
 	// BS_FilSysType
 	if len(b.FileSystemTypeLabel) > 8 {
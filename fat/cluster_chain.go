@@ -17,7 +17,10 @@ type ClusterChain struct {
 
 func (c *ClusterChain) Read(p []byte) (n int, err error) {
 	bpc := c.fat.bs.BytesPerCluster()
-	chain := c.fat.Chain(c.startCluster)
+	chain, err := c.fat.Chain(c.startCluster)
+	if err != nil {
+		return 0, Fatal(err)
+	}
 
 	dataOffset := uint32(0)
 	for dataOffset < uint32(len(p)) {
@@ -50,7 +53,11 @@ func (c *ClusterChain) Read(p []byte) (n int, err error) {
 // Write will write to the cluster chain, expanding it if necessary.
 func (c *ClusterChain) Write(p []byte) (n int, err error) {
 	bpc := c.fat.bs.BytesPerCluster()
-	chain := c.fat.Chain(c.startCluster)
+	chain, err := c.fat.Chain(c.startCluster)
+	if err != nil {
+		return 0, Fatal(err)
+	}
+
 	chainLength := uint32(len(chain)) * bpc
 
 	if chainLength < c.writeOffset+uint32(len(p)) {
@@ -0,0 +1,94 @@
+package fat
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// CodePage is the OEM code page used for the bytes of 8.3 short names
+// and volume labels. Long names are always stored as UTF-16. The zero
+// value is CP437, the code page of US versions of DOS.
+type CodePage int
+
+const (
+	CP437 CodePage = 437
+	CP850 CodePage = 850
+	CP852 CodePage = 852
+	CP866 CodePage = 866
+)
+
+var codePages = map[CodePage]*charmap.Charmap{
+	CP437: charmap.CodePage437,
+	CP850: charmap.CodePage850,
+	CP852: charmap.CodePage852,
+	CP866: charmap.CodePage866,
+}
+
+func (c CodePage) charmap() (*charmap.Charmap, error) {
+	if c == 0 {
+		c = CP437
+	}
+
+	cm, ok := codePages[c]
+	if !ok {
+		return nil, Fatalf("code page %d: %w", int(c), ErrCodePage)
+	}
+
+	return cm, nil
+}
+
+// encodeRune returns the OEM byte for a character, or false if the
+// code page can't represent it.
+func (c CodePage) encodeRune(char rune) (byte, bool) {
+	if char < utf8.RuneSelf {
+		return byte(char), true
+	}
+
+	cm, err := c.charmap()
+	if err != nil {
+		return 0, false
+	}
+
+	return cm.EncodeRune(char)
+}
+
+// Encode converts a string to OEM bytes. It fails if a character can't
+// be represented in the code page.
+func (c CodePage) Encode(s string) (string, error) {
+	if _, err := c.charmap(); err != nil {
+		return "", Fatal(err)
+	}
+
+	var result strings.Builder
+	for _, char := range s {
+		b, ok := c.encodeRune(char)
+		if !ok {
+			return "", Fatalf("%#U not in code page %d: %w", char, int(c), ErrNameIllegalChar)
+		}
+
+		result.WriteByte(b)
+	}
+
+	return result.String(), nil
+}
+
+// Decode converts OEM bytes to a string.
+func (c CodePage) Decode(data string) string {
+	cm, err := c.charmap()
+	if err != nil {
+		return data
+	}
+
+	var result strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] < utf8.RuneSelf {
+			result.WriteByte(data[i])
+		} else {
+			result.WriteRune(cm.DecodeByte(data[i]))
+		}
+	}
+
+	return result.String()
+}
@@ -0,0 +1,113 @@
+package fat
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCodePage_RoundTrip(t *testing.T) {
+	cases := map[CodePage]string{
+		CP437: "CAFÉ ÑÜ",
+		CP850: "ÀÉÎÕÜ Ø",
+		CP852: "ŁÓDŹ ŠČ",
+		CP866: "ФАЙЛ ЖЯ",
+	}
+
+	for codePage, text := range cases {
+		encoded, err := codePage.Encode(text)
+		if err != nil {
+			t.Fatalf("%d: %s", codePage, err)
+		}
+		if len(encoded) != len([]rune(text)) {
+			t.Fatalf("%d: expected one byte per character, got %q", codePage, encoded)
+		}
+		if decoded := codePage.Decode(encoded); decoded != text {
+			t.Fatalf("%d: expected %q, got %q", codePage, text, decoded)
+		}
+	}
+
+	if _, err := CP437.Encode("Ж"); !errors.Is(err, ErrNameIllegalChar) {
+		t.Fatalf("expected ErrNameIllegalChar, got %v", err)
+	}
+	if _, err := CodePage(1252).Encode("a"); !errors.Is(err, ErrCodePage) {
+		t.Fatalf("expected ErrCodePage, got %v", err)
+	}
+}
+
+func TestFileSystem_CodePage(t *testing.T) {
+	device, _ := newTestFloppy(t)
+
+	formatConfig := &SuperFloppyConfig{
+		FATType:  FAT12,
+		Label:    "ДИСК",
+		OEMName:  "ffs",
+		CodePage: CP866,
+	}
+	if err := FormatSuperFloppy(device, formatConfig); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fatFs, err := NewWithConfig(device, &Config{CodePage: CP866})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if label, err := fatFs.VolumeLabel(); err != nil || label != "ДИСК" {
+		t.Fatalf("bad label %q: %v", label, err)
+	}
+
+	// Upper-cased before it is encoded, so the label is stored in the
+	// upper-case letters of the code page
+	if err := fatFs.SetVolumeLabel("том"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if label, err := fatFs.VolumeLabel(); err != nil || label != "ТОМ" {
+		t.Fatalf("bad label %q: %v", label, err)
+	}
+	if raw := fatFs.volumeEntry().name; raw != "\x92\x8e\x8c" {
+		t.Fatalf("bad OEM bytes: % x", raw)
+	}
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := rootDir.AddFile("файл.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Not in CP866, so it is replaced in the short name
+	if _, err := rootDir.AddFile("é.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry := rootDir.Entry("ФАЙЛ.TXT")
+	if entry == nil {
+		t.Fatal("entry not found")
+	}
+	if entry.ShortName() != "ФАЙЛ.TXT" {
+		t.Fatalf("bad short name: %q", entry.ShortName())
+	}
+	if raw := entry.(*DirectoryEntry).entry.name; raw != "\x94\x80\x89\x8b" {
+		t.Fatalf("bad OEM bytes: % x", raw)
+	}
+	if short := rootDir.Entry("é.txt").ShortName(); short != "_~1.TXT" {
+		t.Fatalf("bad short name: %q", short)
+	}
+
+	// The same bytes read with another code page
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rootDir, err = fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if rootDir.Entry("ФАЙЛ.TXT") != nil || rootDir.Entry("öÇëï.TXT") == nil {
+		t.Fatal("short names should be decoded with CP437")
+	}
+
+	if _, err := NewWithConfig(device, &Config{CodePage: 1252}); !errors.Is(err, ErrCodePage) {
+		t.Fatalf("expected ErrCodePage, got %v", err)
+	}
+}
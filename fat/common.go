@@ -3,13 +3,21 @@
 package fat
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/rstms/ffs/internal/fatal"
 	"github.com/rstms/go-common"
 )
 
 func Fatal(err error) error {
-	return common.Fatal(err)
+	return fatal.Wrap(common.Fatal(err), err)
 }
 
 func Fatalf(format string, args ...interface{}) error {
-	return common.Fatalf(format, args...)
+	err := fmt.Errorf(format, args...)
+	if errors.Unwrap(err) == nil {
+		return common.Fatalf(format, args...)
+	}
+	return fatal.Wrap(common.Fatal(err), err)
 }
@@ -0,0 +1,132 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentImport(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	const workers = 8
+	const files = 5
+
+	contents := func(w, f int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("worker %d file %d\n", w, f)), 100*(f+1))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+	done := make(chan struct{})
+
+	// Readers walk the root directory while the writers import
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, entry := range rootDir.Entries() {
+					if entry.IsDir() && entry.Name() != "." {
+						if _, err := entry.Dir(); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			entry, err := rootDir.AddDirectory(fmt.Sprintf("DIR%d", w))
+			if err != nil {
+				errs <- err
+				return
+			}
+			dir, err := entry.Dir()
+			if err != nil {
+				errs <- err
+				return
+			}
+			for f := 0; f < files; f++ {
+				fileEntry, err := dir.AddFile(fmt.Sprintf("file%d.txt", f))
+				if err != nil {
+					errs <- err
+					return
+				}
+				file, err := fileEntry.File()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := file.Write(contents(w, f)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	writers.Wait()
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Re-open the filesystem and verify every file
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rootDir, err = fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for w := 0; w < workers; w++ {
+		entry := rootDir.Entry(fmt.Sprintf("DIR%d", w))
+		if entry == nil {
+			t.Fatalf("DIR%d not found", w)
+		}
+		dir, err := entry.Dir()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for f := 0; f < files; f++ {
+			fileEntry := dir.Entry(fmt.Sprintf("file%d.txt", f))
+			if fileEntry == nil {
+				t.Fatalf("DIR%d/file%d.txt not found", w, f)
+			}
+			file, err := fileEntry.File()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			expected := contents(w, f)
+			data := make([]byte, len(expected))
+			if _, err := io.ReadFull(file, data); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if !bytes.Equal(data, expected) {
+				t.Fatalf("DIR%d/file%d.txt corrupted", w, f)
+			}
+		}
+	}
+}
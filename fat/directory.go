@@ -1,9 +1,10 @@
 package fat
 
 import (
-	"fmt"
+	"os"
 	"strings"
 	"time"
+	"unicode/utf16"
 
 	"github.com/rstms/ffs"
 )
@@ -14,6 +15,7 @@ type Directory struct {
 	device     ffs.BlockDevice
 	dirCluster *DirectoryCluster
 	fat        *FAT
+	fs         *FileSystem
 }
 
 // ensure Directory implements ffs.Directory
@@ -60,20 +62,24 @@ func DecodeDirectoryEntry(d *Directory, entries []*DirectoryClusterEntry) (*Dire
 	// we're done. Also, calculate out the name and such.
 	if entries[0].IsLong() {
 		lfnEntries = make([]*DirectoryClusterEntry, 0, 3)
-		for entries[0].IsLong() {
+		for len(entries) > 0 && entries[0].IsLong() {
 			lfnEntries = append(lfnEntries, entries[0])
 			entries = entries[1:]
 		}
 
-		var nameBytes []rune
-		nameBytes = make([]rune, 0, 13*len(lfnEntries))
+		// Long entries without a short entry are orphans, skip them
+		if len(entries) == 0 {
+			return nil, entries, nil
+		}
+
+		// The parts are stored last first. They are joined before
+		// decoding since a surrogate pair may span two entries.
+		units := make([]uint16, 0, LongNameEntryChars*len(lfnEntries))
 		for i := len(lfnEntries) - 1; i >= 0; i-- {
-			for _, char := range lfnEntries[i].longName {
-				nameBytes = append(nameBytes, char)
-			}
+			units = append(units, lfnEntries[i].longName...)
 		}
 
-		name = string(nameBytes)
+		name = string(utf16.Decode(units))
 	}
 
 	// Get the short entry
@@ -86,11 +92,7 @@ func DecodeDirectoryEntry(d *Directory, entries []*DirectoryClusterEntry) (*Dire
 	}
 
 	if name == "" {
-		name = strings.TrimSpace(entry.name)
-		ext := strings.TrimSpace(entry.ext)
-		if ext != "" {
-			name = fmt.Sprintf("%s.%s", name, ext)
-		}
+		name = entry.displayName(d.fs.codePage)
 	}
 
 	result := &DirectoryEntry{
@@ -104,12 +106,23 @@ func DecodeDirectoryEntry(d *Directory, entries []*DirectoryClusterEntry) (*Dire
 }
 
 func (d *DirectoryEntry) Dir() (ffs.Directory, error) {
-	if !d.IsDir() {
-		panic("not a directory")
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
+	dir, err := d.openDir()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return dir, nil
+}
+
+func (d *DirectoryEntry) openDir() (*Directory, error) {
+	if !d.isDir() {
+		return nil, Fatal(&PathError{Op: "open", Path: d.name, Err: ErrNotDir})
 	}
 
-	dirCluster, err := DecodeDirectoryCluster(
-		d.entry.cluster, d.dir.device, d.dir.fat)
+	dirCluster, err := d.dir.fs.dirCluster(d.entry.cluster)
 	if err != nil {
 		return nil, Fatal(err)
 	}
@@ -118,14 +131,27 @@ func (d *DirectoryEntry) Dir() (ffs.Directory, error) {
 		device:     d.dir.device,
 		dirCluster: dirCluster,
 		fat:        d.dir.fat,
+		fs:         d.dir.fs,
 	}
 
 	return result, nil
 }
 
 func (d *DirectoryEntry) File() (ffs.File, error) {
-	if d.IsDir() {
-		panic("not a file")
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
+	file, err := d.openFile(os.O_RDWR)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return file, nil
+}
+
+func (d *DirectoryEntry) openFile(flag int) (*File, error) {
+	if d.isDir() {
+		return nil, Fatal(&PathError{Op: "open", Path: d.name, Err: ErrIsDir})
 	}
 
 	result := &File{
@@ -136,16 +162,28 @@ func (d *DirectoryEntry) File() (ffs.File, error) {
 		},
 		dir:   d.dir,
 		entry: d.entry,
+		name:  d.name,
+		flag:  flag,
 	}
 
 	return result, nil
 }
 
 func (d *DirectoryEntry) IsDir() bool {
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
+	return d.isDir()
+}
+
+func (d *DirectoryEntry) isDir() bool {
 	return (d.entry.attr & ffs.AttrDirectory) == ffs.AttrDirectory
 }
 
 func (d *DirectoryEntry) IsVolumeId() bool {
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
 	return (d.entry.attr & ffs.AttrVolumeId) == ffs.AttrVolumeId
 }
 
@@ -154,10 +192,20 @@ func (d *DirectoryEntry) Name() string {
 }
 
 func (d *DirectoryEntry) Attr() ffs.DirectoryAttr {
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
 	return d.entry.attr
 }
 
 func (d *DirectoryEntry) SetAttr(attr ffs.DirectoryAttr, state bool) error {
+	d.dir.fs.lock.Lock()
+	defer d.dir.fs.lock.Unlock()
+
+	if err := d.dir.fs.checkWritable("chattr", d.name); err != nil {
+		return Fatal(err)
+	}
+
 	switch attr {
 	case ffs.AttrHidden:
 	case ffs.AttrSystem:
@@ -202,14 +250,23 @@ func (d *DirectoryEntry) SetHidden(state bool) error {
 }
 
 func (d *DirectoryEntry) IsReadOnly() bool {
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
 	return d.entry.attr&ffs.AttrReadOnly == ffs.AttrReadOnly
 }
 
 func (d *DirectoryEntry) IsSystem() bool {
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
 	return d.entry.attr&ffs.AttrSystem == ffs.AttrSystem
 }
 
 func (d *DirectoryEntry) IsHidden() bool {
+	d.dir.fs.lock.RLock()
+	defer d.dir.fs.lock.RUnlock()
+
 	return d.entry.attr&ffs.AttrHidden == ffs.AttrHidden
 }
 
@@ -218,10 +275,26 @@ func (d *DirectoryEntry) ShortName() string {
 		return d.entry.name
 	}
 
-	return fmt.Sprintf("%s.%s", d.entry.name, d.entry.ext)
+	return d.dir.fs.codePage.Decode(d.entry.shortName())
 }
 
 func (d *Directory) AddDirectory(name string) (ffs.DirectoryEntry, error) {
+	d.fs.lock.Lock()
+	defer d.fs.lock.Unlock()
+
+	if err := d.fs.checkWritable("mkdir", name); err != nil {
+		return nil, Fatal(err)
+	}
+
+	entry, err := d.addDirectory(name)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return entry, nil
+}
+
+func (d *Directory) addDirectory(name string) (*DirectoryEntry, error) {
 	entry, err := d.addEntry(name, ffs.AttrDirectory)
 	if err != nil {
 		return nil, Fatal(err)
@@ -235,10 +308,18 @@ func (d *Directory) AddDirectory(name string) (ffs.DirectoryEntry, error) {
 		return nil, Fatal(err)
 	}
 
+	d.fs.addDirCluster(newDirCluster)
 	return entry, nil
 }
 
 func (d *Directory) AddFile(name string) (ffs.DirectoryEntry, error) {
+	d.fs.lock.Lock()
+	defer d.fs.lock.Unlock()
+
+	if err := d.fs.checkWritable("create", name); err != nil {
+		return nil, Fatal(err)
+	}
+
 	entry, err := d.addEntry(name, ffs.DirectoryAttr(0))
 	if err != nil {
 		return nil, Fatal(err)
@@ -248,8 +329,21 @@ func (d *Directory) AddFile(name string) (ffs.DirectoryEntry, error) {
 }
 
 func (d *Directory) Entries() []ffs.DirectoryEntry {
+	d.fs.lock.RLock()
+	defer d.fs.lock.RUnlock()
+
+	entries := d.entries()
+	result := make([]ffs.DirectoryEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = entry
+	}
+
+	return result
+}
+
+func (d *Directory) entries() []*DirectoryEntry {
 	entries := d.dirCluster.entries
-	result := make([]ffs.DirectoryEntry, 0, len(entries)/2)
+	result := make([]*DirectoryEntry, 0, len(entries)/2)
 	for len(entries) > 0 {
 		var entry *DirectoryEntry
 		entry, entries, _ = DecodeDirectoryEntry(d, entries)
@@ -262,10 +356,22 @@ func (d *Directory) Entries() []ffs.DirectoryEntry {
 }
 
 func (d *Directory) Entry(name string) ffs.DirectoryEntry {
-	name = strings.ToUpper(name)
+	d.fs.lock.RLock()
+	defer d.fs.lock.RUnlock()
 
-	for _, entry := range d.Entries() {
-		if strings.ToUpper(entry.Name()) == name {
+	// Avoid returning a typed nil in the interface
+	if entry := d.entry(name); entry != nil {
+		return entry
+	}
+
+	return nil
+}
+
+// entry returns the entry with the given name. Like Windows, names are
+// compared using Unicode simple case folding.
+func (d *Directory) entry(name string) *DirectoryEntry {
+	for _, entry := range d.entries() {
+		if strings.EqualFold(entry.Name(), name) {
 			return entry
 		}
 	}
@@ -273,34 +379,60 @@ func (d *Directory) Entry(name string) ffs.DirectoryEntry {
 	return nil
 }
 
-func (d *Directory) addEntry(name string, attr ffs.DirectoryAttr) (*DirectoryEntry, error) {
-	name = strings.TrimSpace(name)
+// nameIndex returns the index of the names in the directory, building
+// it if necessary.
+func (d *Directory) nameIndex() *nameIndex {
+	if d.dirCluster.index == nil {
+		entries := d.entries()
+		index := &nameIndex{
+			names:      make(map[string]bool, len(entries)),
+			shortNames: make(shortNameIndex, len(entries)),
+		}
 
-	entries := d.Entries()
-	usedNames := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if strings.ToUpper(entry.Name()) == strings.ToUpper(name) {
-			return nil, Fatalf("name already exists: %s", name)
+		for _, entry := range entries {
+			index.add(entry.name, entry.entry.shortName())
 		}
 
-		// Add it to the list of used names
-		dirEntry := entry.(*DirectoryEntry)
-		usedNames = append(usedNames, dirEntry.ShortName())
+		d.dirCluster.index = index
 	}
 
-	shortName, err := generateShortName(name, usedNames)
+	return d.dirCluster.index
+}
+
+func (d *Directory) addEntry(name string, attr ffs.DirectoryAttr) (*DirectoryEntry, error) {
+	name = strings.TrimSpace(name)
+	if err := ValidateName(name); err != nil {
+		return nil, Fatal(&PathError{Op: "create", Path: name, Err: err})
+	}
+
+	index := d.nameIndex()
+	if index.names[foldName(name)] {
+		return nil, Fatal(&PathError{Op: "create", Path: name, Err: ErrExist})
+	}
+
+	shortName, err := index.shortNames.generate(name, d.fs.codePage)
 	if err != nil {
 		return nil, Fatal(err)
 	}
 
+	// Names that only differ from the short name by an all lower
+	// case base or extension don't need long entries
+	ntCase, caseOnly := shortNameCase(name, d.fs.codePage.Decode(shortName))
+
 	var lfnEntries []*DirectoryClusterEntry
-	if shortName != strings.ToUpper(name) {
+	if !caseOnly {
 		lfnEntries, err = NewLongDirectoryClusterEntry(name, shortName)
 		if err != nil {
 			return nil, Fatal(err)
 		}
 	}
 
+	// Check for room before anything is allocated
+	slot := d.dirCluster.freeSlot(len(lfnEntries) + 1)
+	if slot < 0 && !d.dirCluster.hasRoomFor(len(lfnEntries)+1, d.fat.bs) {
+		return nil, Fatal(ErrRootDirFull)
+	}
+
 	// Allocate space for a cluster
 	startCluster, err := d.fat.AllocChain()
 	if err != nil {
@@ -319,6 +451,7 @@ func (d *Directory) addEntry(name string, attr ffs.DirectoryAttr) (*DirectoryEnt
 	shortEntry.attr = attr
 	shortEntry.name = shortParts[0]
 	shortEntry.ext = shortParts[1]
+	shortEntry.ntCase = ntCase
 	shortEntry.cluster = startCluster
 	shortEntry.accessTime = createTime
 	shortEntry.createTime = createTime
@@ -329,20 +462,25 @@ func (d *Directory) addEntry(name string, attr ffs.DirectoryAttr) (*DirectoryEnt
 		return nil, Fatal(err)
 	}
 
-	// Write the entries out in this directory
-	if lfnEntries != nil {
-		d.dirCluster.entries = append(d.dirCluster.entries, lfnEntries...)
+	// Write the entries out in this directory, reusing the slots of
+	// deleted entries if there is a large enough run of them
+	newEntries := append(lfnEntries, shortEntry)
+	if slot >= 0 {
+		copy(d.dirCluster.entries[slot:], newEntries)
+	} else {
+		d.dirCluster.entries = append(d.dirCluster.entries, newEntries...)
 	}
-	d.dirCluster.entries = append(d.dirCluster.entries, shortEntry)
 
 	if err := d.dirCluster.WriteToDevice(d.device, d.fat); err != nil {
 		return nil, Fatal(err)
 	}
 
+	index.add(name, shortName)
 	newEntry := &DirectoryEntry{
 		dir:        d,
 		lfnEntries: lfnEntries,
 		entry:      shortEntry,
+		name:       name,
 	}
 
 	return newEntry, nil
@@ -1,10 +1,8 @@
 package fat
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
-	"math"
 	"strings"
 	"time"
 	"unicode/utf16"
@@ -18,12 +16,46 @@ const DirectoryEntrySize = 32
 // Mask applied to the ord of the last long entry.
 const LastLongEntryMask = 0x40
 
+// Flags in DIR_NTRes set by Windows NT for short names that are shown
+// with a lower case base name or extension.
+const (
+	NTLowerBase = 0x08
+	NTLowerExt  = 0x10
+)
+
+// The number of UTF-16 code units held by a single long entry.
+const LongNameEntryChars = 13
+
+// The maximum length of a long name in UTF-16 code units.
+const MaxLongNameLength = 255
+
 // DirectoryCluster represents a cluster on the disk that contains
 // entries/contents.
 type DirectoryCluster struct {
 	entries      []*DirectoryClusterEntry
 	fat16Root    bool
 	startCluster uint32
+
+	// index is built on the first addition to the directory
+	index *nameIndex
+}
+
+// nameIndex holds the names in use in a directory, so that adding an
+// entry doesn't have to decode and compare every existing one.
+type nameIndex struct {
+	// names holds the folded names, see foldName
+	names      map[string]bool
+	shortNames shortNameIndex
+}
+
+func (i *nameIndex) add(name, shortName string) {
+	i.names[foldName(name)] = true
+	i.shortNames[shortName] = true
+}
+
+func (i *nameIndex) remove(name, shortName string) {
+	delete(i.names, foldName(name))
+	delete(i.shortNames, shortName)
 }
 
 // DirectoryClusterEntry is a single 32-byte entry that is part of the
@@ -38,15 +70,22 @@ type DirectoryClusterEntry struct {
 	cluster    uint32
 	fileSize   uint32
 	deleted    bool
+	ntCase     uint8
 
+	// longName holds the UTF-16 code units of this part of a long
+	// name, without the terminator and padding
 	longOrd      uint8
-	longName     string
+	longName     []uint16
 	longChecksum uint8
 }
 
 func DecodeDirectoryCluster(startCluster uint32, device ffs.BlockDevice, fat *FAT) (*DirectoryCluster, error) {
 	bs := fat.bs
-	chain := fat.Chain(startCluster)
+	chain, err := fat.Chain(startCluster)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
 	data := make([]byte, uint32(len(chain))*bs.BytesPerCluster())
 	for i, clusterNumber := range chain {
 		dataOffset := uint32(i) * bs.BytesPerCluster()
@@ -78,7 +117,7 @@ func DecodeFAT32RootDirectoryCluster(device ffs.BlockDevice, fat *FAT) (*Directo
 // DecodeFAT16RootDirectory decodes the FAT16 root directory structure
 // from the device.
 func DecodeFAT16RootDirectoryCluster(device ffs.BlockDevice, bs *BootSectorCommon) (*DirectoryCluster, error) {
-	data := make([]byte, DirectoryEntrySize*bs.RootEntryCount)
+	data := make([]byte, DirectoryEntrySize*int(bs.RootEntryCount))
 	if _, err := device.ReadAt(data, int64(bs.RootDirOffset())); err != nil {
 		return nil, Fatal(err)
 	}
@@ -94,7 +133,7 @@ func DecodeFAT16RootDirectoryCluster(device ffs.BlockDevice, bs *BootSectorCommo
 
 func decodeDirectoryCluster(data []byte, bs *BootSectorCommon) (*DirectoryCluster, error) {
 	entries := make([]*DirectoryClusterEntry, 0, bs.RootEntryCount)
-	for i := uint16(0); i < uint16(len(data)/DirectoryEntrySize); i++ {
+	for i := 0; i < len(data)/DirectoryEntrySize; i++ {
 		offset := i * DirectoryEntrySize
 		entryData := data[offset : offset+DirectoryEntrySize]
 		if entryData[0] == 0 {
@@ -144,29 +183,55 @@ func NewDirectoryCluster(start uint32, parent uint32, t time.Time) *DirectoryClu
 }
 
 // NewFat16RootDirectory creates a new DirectoryCluster that is meant only
-// to be the root directory of a FAT12/FAT16 filesystem.
+// to be the root directory of a FAT12/FAT16 filesystem. The label is in
+// OEM bytes.
 func NewFat16RootDirectoryCluster(bs *BootSectorCommon, label string) (*DirectoryCluster, error) {
 	if bs.RootEntryCount == 0 {
 		return nil, Fatalf("root entry count is 0 in boot sector")
 	}
 
 	result := &DirectoryCluster{
-		entries: make([]*DirectoryClusterEntry, 1, bs.RootEntryCount),
+		entries:   make([]*DirectoryClusterEntry, 1, bs.RootEntryCount),
+		fat16Root: true,
 	}
 
 	// Create the volume ID entry
-	result.entries[0] = &DirectoryClusterEntry{
-		attr:    ffs.AttrVolumeId,
-		name:    label,
-		cluster: 0,
-	}
+	result.entries[0] = newVolumeEntry(label, time.Now())
 
 	return result, nil
 }
 
+// newVolumeEntry returns a volume ID entry for a label in OEM bytes. The
+// label spans the name and extension fields.
+func newVolumeEntry(label string, t time.Time) *DirectoryClusterEntry {
+	label = strings.TrimRight(label, " ")
+	var ext string
+	if len(label) > 8 {
+		label, ext = label[:8], label[8:]
+	}
+
+	return &DirectoryClusterEntry{
+		attr:       ffs.AttrVolumeId,
+		name:       label,
+		ext:        ext,
+		createTime: t,
+		accessTime: t,
+		writeTime:  t,
+	}
+}
+
+// volumeLabel returns the label of a volume ID entry in OEM bytes.
+func (d *DirectoryClusterEntry) volumeLabel() string {
+	if d.ext == "" {
+		return d.name
+	}
+
+	return fmt.Sprintf("%-8s%s", d.name, d.ext)
+}
+
 // Bytes returns the on-disk byte data for this directory structure.
 func (d *DirectoryCluster) Bytes() []byte {
-	result := make([]byte, cap(d.entries)*DirectoryEntrySize)
+	result := make([]byte, len(d.entries)*DirectoryEntrySize)
 
 	for i, entry := range d.entries {
 		offset := i * DirectoryEntrySize
@@ -177,22 +242,38 @@ func (d *DirectoryCluster) Bytes() []byte {
 	return result
 }
 
-// WriteToDevice writes the cluster to the device.
+// WriteToDevice writes the cluster to the device. The unused space
+// after the last entry is zeroed, and a directory that outgrew its
+// cluster chain is extended by whole clusters.
 func (d *DirectoryCluster) WriteToDevice(device ffs.BlockDevice, fat *FAT) error {
+	data := d.Bytes()
+
 	if d.fat16Root {
+		// The FAT12/16 root directory has a fixed size
+		size := int(fat.bs.RootEntryCount) * DirectoryEntrySize
+		if len(data) > size {
+			return Fatal(ErrRootDirFull)
+		}
+
 		// Write the cluster to the FAT16 root directory location
 		offset := int64(fat.bs.RootDirOffset())
-		if _, err := device.WriteAt(d.Bytes(), offset); err != nil {
+		if _, err := device.WriteAt(pad(data, size), offset); err != nil {
 			return Fatal(err)
 		}
 	} else {
+		bpc := int(fat.bs.BytesPerCluster())
+		size := ((len(data) + bpc - 1) / bpc) * bpc
+		if size == 0 {
+			size = bpc
+		}
+
 		chain := &ClusterChain{
 			device:       device,
 			fat:          fat,
 			startCluster: d.startCluster,
 		}
 
-		if _, err := chain.Write(d.Bytes()); err != nil {
+		if _, err := chain.Write(pad(data, size)); err != nil {
 			return Fatal(err)
 		}
 	}
@@ -200,30 +281,75 @@ func (d *DirectoryCluster) WriteToDevice(device ffs.BlockDevice, fat *FAT) error
 	return nil
 }
 
+// freeSlot returns the index of the first run of n deleted entries that
+// can be reused, or -1 if there is none.
+func (d *DirectoryCluster) freeSlot(n int) int {
+	run := 0
+	for i, entry := range d.entries {
+		if !entry.deleted {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == n {
+			return i - n + 1
+		}
+	}
+
+	return -1
+}
+
+// hasRoomFor reports whether n more entries fit into the directory.
+// Only the FAT12/16 root directory is limited; other directories grow
+// as needed.
+func (d *DirectoryCluster) hasRoomFor(n int, bs *BootSectorCommon) bool {
+	if !d.fat16Root {
+		return true
+	}
+
+	return len(d.entries)+n <= int(bs.RootEntryCount)
+}
+
+// pad returns data extended with zeros up to size bytes.
+func pad(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+
+	result := make([]byte, size)
+	copy(result, data)
+	return result
+}
+
 // Bytes returns the on-disk byte data for this directory entry.
 func (d *DirectoryClusterEntry) Bytes() []byte {
 	var result [DirectoryEntrySize]byte
 
-	if d.longName != "" {
-		runes := bytes.Runes([]byte(d.longName))
+	if d.IsLong() {
+		units := make([]uint16, 0, LongNameEntryChars)
+		units = append(units, d.longName...)
 
-		// The name must be zero-terminated then padded with 0xFF
-		// up to 13 characters
-		if len(runes) < 13 {
-			runes = append(runes, 0)
-			for len(runes) < 13 {
-				runes = append(runes, 0xFFFF)
+		// A partial name must be zero-terminated then padded with
+		// 0xFFFF up to 13 characters
+		if len(units) < LongNameEntryChars {
+			units = append(units, 0)
+			for len(units) < LongNameEntryChars {
+				units = append(units, 0xFFFF)
 			}
 		}
 
 		// LDIR_Ord
 		result[0] = d.longOrd
+		if d.deleted {
+			result[0] = 0xE5
+		}
 
 		// LDIR_Name1
-		for i := 0; i < int(math.Min(float64(len(runes)), 5)); i++ {
+		for i := 0; i < 5; i++ {
 			offset := 1 + (i * 2)
 			data := result[offset : offset+2]
-			binary.LittleEndian.PutUint16(data, uint16(runes[i]))
+			binary.LittleEndian.PutUint16(data, units[i])
 		}
 
 		// LDIR_Attr
@@ -239,7 +365,7 @@ func (d *DirectoryClusterEntry) Bytes() []byte {
 		for i := 0; i < 6; i++ {
 			offset := 14 + (i * 2)
 			data := result[offset : offset+2]
-			binary.LittleEndian.PutUint16(data, uint16(runes[i+5]))
+			binary.LittleEndian.PutUint16(data, units[i+5])
 		}
 
 		// LDIR_FstClusLO
@@ -250,7 +376,7 @@ func (d *DirectoryClusterEntry) Bytes() []byte {
 		for i := 0; i < 2; i++ {
 			offset := 28 + (i * 2)
 			data := result[offset : offset+2]
-			binary.LittleEndian.PutUint16(data, uint16(runes[i+11]))
+			binary.LittleEndian.PutUint16(data, units[i+11])
 		}
 	} else {
 		// DIR_Name
@@ -262,9 +388,20 @@ func (d *DirectoryClusterEntry) Bytes() []byte {
 		}
 		copy(result[0:11], shortNameEntryValue(simpleName))
 
+		// 0xE5 marks a deleted entry, a name that really starts
+		// with that byte is stored as 0x05 instead
+		if d.deleted {
+			result[0] = 0xE5
+		} else if result[0] == 0xE5 {
+			result[0] = 0x05
+		}
+
 		// DIR_Attr
 		result[11] = byte(d.attr)
 
+		// DIR_NTRes
+		result[12] = d.ntCase & (NTLowerBase | NTLowerExt)
+
 		// DIR_CrtTime
 		crtDate, crtTime, crtTenths := encodeDOSTime(d.createTime)
 		result[13] = crtTenths
@@ -293,6 +430,36 @@ func (d *DirectoryClusterEntry) Bytes() []byte {
 	return result[:]
 }
 
+// shortName returns the short name as "NAME.EXT", or "NAME" if there is
+// no extension, in OEM bytes.
+func (d *DirectoryClusterEntry) shortName() string {
+	if d.ext == "" {
+		return d.name
+	}
+
+	return d.name + "." + d.ext
+}
+
+// displayName returns the short name as shown to the user, decoded from
+// the code page and with the NT case flags applied.
+func (d *DirectoryClusterEntry) displayName(codePage CodePage) string {
+	name := codePage.Decode(d.name)
+	if d.ntCase&NTLowerBase != 0 {
+		name = strings.ToLower(name)
+	}
+
+	if d.ext == "" {
+		return name
+	}
+
+	ext := codePage.Decode(d.ext)
+	if d.ntCase&NTLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+
+	return name + "." + ext
+}
+
 // IsLong returns true if this is a long entry.
 func (d *DirectoryClusterEntry) IsLong() bool {
 	return (d.attr & ffs.AttrLongName) == ffs.AttrLongName
@@ -307,9 +474,14 @@ func (d *DirectoryClusterEntry) IsVolumeId() bool {
 func DecodeDirectoryClusterEntry(data []byte) (*DirectoryClusterEntry, error) {
 	var result DirectoryClusterEntry
 
+	if len(data) < DirectoryEntrySize {
+		return nil, Fatalf("short directory entry of %d bytes: %w", len(data), ErrCorrupt)
+	}
+
 	// Do the attributes so we can determine if we're dealing with long names
 	result.attr = ffs.DirectoryAttr(data[11])
 	if (result.attr & ffs.AttrLongName) == ffs.AttrLongName {
+		result.deleted = data[0] == 0xE5
 		result.longOrd = data[0]
 
 		chars := make([]uint16, 13)
@@ -328,11 +500,15 @@ func DecodeDirectoryClusterEntry(data []byte) (*DirectoryClusterEntry, error) {
 			chars[i+11] = binary.LittleEndian.Uint16(data[offset : offset+2])
 		}
 
-		result.longName = string(utf16.Decode(chars))
-		idx := strings.IndexByte(result.longName, 0)
-		if idx > 0 {
-			result.longName = result.longName[:idx]
+		// Everything from the terminator on is padding
+		for i, char := range chars {
+			if char == 0 {
+				chars = chars[:i]
+				break
+			}
 		}
+
+		result.longName = chars
 		result.longChecksum = data[13]
 	} else {
 		result.deleted = data[0] == 0xE5
@@ -346,6 +522,9 @@ func DecodeDirectoryClusterEntry(data []byte) (*DirectoryClusterEntry, error) {
 		result.ext = strings.TrimRight(string(data[8:11]), " ")
 
 		// Creation time
+		// Case flags
+		result.ntCase = data[12] & (NTLowerBase | NTLowerExt)
+
 		createTimeTenths := data[13]
 		createTimeWord := binary.LittleEndian.Uint16(data[14:16])
 		createDateWord := binary.LittleEndian.Uint16(data[16:18])
@@ -362,7 +541,7 @@ func DecodeDirectoryClusterEntry(data []byte) (*DirectoryClusterEntry, error) {
 
 		// Cluster
 		result.cluster = uint32(binary.LittleEndian.Uint16(data[20:22]))
-		result.cluster <<= 4
+		result.cluster <<= 16
 		result.cluster |= uint32(binary.LittleEndian.Uint16(data[26:28]))
 
 		// File size
@@ -379,10 +558,17 @@ func NewLongDirectoryClusterEntry(name string, shortName string) ([]*DirectoryCl
 	// Split up the shortName properly
 	checksum := checksumShortName(shortNameEntryValue(shortName))
 
-	// Calcualte the number of entries we'll actually need to store
+	// Long names are stored as UTF-16, characters outside the BMP
+	// take two code units
+	units := utf16.Encode([]rune(name))
+	if len(units) > MaxLongNameLength {
+		return nil, Fatal(&PathError{Op: "create", Path: name, Err: ErrNameTooLong})
+	}
+
+	// Calculate the number of entries we'll actually need to store
 	// the long name.
-	numLongEntries := len(name) / 13
-	if len(name)%13 != 0 {
+	numLongEntries := len(units) / LongNameEntryChars
+	if len(units)%LongNameEntryChars != 0 {
 		numLongEntries++
 	}
 
@@ -398,14 +584,14 @@ func NewLongDirectoryClusterEntry(name string, shortName string) ([]*DirectoryCl
 		}
 
 		// Calculate the offsets of the string for this entry
-		j := (numLongEntries - i - 1) * 13
-		k := j + 13
-		if k > len(name) {
-			k = len(name)
+		j := (numLongEntries - i - 1) * LongNameEntryChars
+		k := j + LongNameEntryChars
+		if k > len(units) {
+			k = len(units)
 		}
 
 		entry.longChecksum = checksum
-		entry.longName = name[j:k]
+		entry.longName = units[j:k]
 	}
 
 	return entries, nil
@@ -0,0 +1,357 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestDirectory_SharedHandles(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddDirectory("SUB"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Two independent handles to the same directory
+	first, err := rootDir.Entry("SUB").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	second, err := rootDir.Entry("SUB").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry, err := first.AddFile("ONE.TXT")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := second.AddFile("TWO.TXT"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A write through the first handle must not lose the second file
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := io.WriteString(file, "hello"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if first.Entry("TWO.TXT") == nil || second.Entry("ONE.TXT") == nil {
+		t.Fatal("handles should see each other's entries")
+	}
+
+	// Re-read everything from the device
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rootDir, err = fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sub, err := rootDir.Entry("SUB").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, name := range []string{"ONE.TXT", "TWO.TXT"} {
+		if sub.Entry(name) == nil {
+			t.Fatalf("%s missing after reopen", name)
+		}
+	}
+}
+
+func TestDirectory_GrowSubdirectory(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	subEntry, err := rootDir.AddDirectory("SUB")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sub, err := subEntry.Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// 40 short entries need three 512 byte clusters
+	for i := 0; i < 40; i++ {
+		if _, err := sub.AddFile(fmt.Sprintf("F%d.TXT", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rootDir, err = fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sub, err = rootDir.Entry("SUB").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// ".", ".." and the 40 files, and no garbage from the new clusters
+	if n := len(sub.Entries()); n != 42 {
+		t.Fatalf("expected 42 entries, got %d", n)
+	}
+	chain, err := fatFs.fat.Chain(subEntry.(*DirectoryEntry).entry.cluster)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(chain) != 3 {
+		t.Fatalf("expected 3 clusters, got %d", len(chain))
+	}
+}
+
+func TestDirectory_LargeSubdirectory(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	if err := fatFs.Mkdir("SUB"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// More than 64 KB of entries, past the range of a 16 bit offset
+	const count = 2100
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	subDir, err := rootDir.Entry("SUB").Dir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i := 0; i < count; i++ {
+		if _, err := subDir.AddFile(fmt.Sprintf("F%d.TXT", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	entries, err := fatFs.ReadDir("SUB")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(entries) != count {
+		t.Fatalf("expected %d entries, got %d", count, len(entries))
+	}
+}
+
+func TestDirectory_RootDirFull(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The 1.44MB root holds 224 entries, one of them the volume label
+	for i := 0; i < 223; i++ {
+		if _, err := rootDir.AddFile(fmt.Sprintf("F%d.TXT", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	_, err = rootDir.AddFile("ONEMORE.TXT")
+	if err == nil || !strings.Contains(err.Error(), ErrRootDirFull.Error()) {
+		t.Fatalf("expected ErrRootDirFull, got %v", err)
+	}
+}
+
+func TestDirectory_AddExisting(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := rootDir.AddFile("readme.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, err = rootDir.AddFile("README.TXT")
+	if !errors.Is(err, ErrExist) || !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+
+	var pathErr *PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "README.TXT" {
+		t.Fatalf("expected a PathError for README.TXT, got %v", err)
+	}
+}
+
+func TestDirectory_RootDirFullIsNoSpace(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i := 0; i < 223; i++ {
+		if _, err := rootDir.AddFile(fmt.Sprintf("F%d.TXT", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	_, err = rootDir.AddFile("ONEMORE.TXT")
+	if !errors.Is(err, ErrRootDirFull) || !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("expected ErrRootDirFull wrapping ErrNoSpace, got %v", err)
+	}
+}
+
+func TestDirectory_UnicodeNames(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	names := []string{
+		"Ünïcödé файл.txt",
+		"emoji 😀 in the name.txt",
+		"exactly13.abc",
+		"thirteen char",
+		strings.Repeat("ж", MaxLongNameLength),
+	}
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, name := range names {
+		if _, err := rootDir.AddFile(name); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+
+	if _, err := rootDir.AddFile(strings.Repeat("ж", MaxLongNameLength+1)); !errors.Is(err, ErrNameTooLong) {
+		t.Fatalf("expected ErrNameTooLong, got %v", err)
+	}
+	// A character outside the BMP counts as two code units
+	if _, err := rootDir.AddFile(strings.Repeat("😀", 128)); !errors.Is(err, ErrNameTooLong) {
+		t.Fatalf("expected ErrNameTooLong, got %v", err)
+	}
+
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rootDir, err = fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, name := range names {
+		entry := rootDir.Entry(name)
+		if entry == nil || entry.Name() != name {
+			t.Fatalf("%s: not found after reopening", name)
+		}
+	}
+
+	// Lookups fold case beyond ASCII
+	for _, name := range []string{"üNÏCÖDÉ ФАЙЛ.TXT", "EMOJI 😀 IN THE NAME.TXT"} {
+		if rootDir.Entry(name) == nil {
+			t.Fatalf("%s: not found", name)
+		}
+	}
+}
+
+func TestDirectoryClusterEntry_LongNamePadding(t *testing.T) {
+	entries, err := NewLongDirectoryClusterEntry("a😀", "A_~1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+
+	data := entries[0].Bytes()
+	expected := []uint16{'a', 0xD83D, 0xDE00, 0, 0xFFFF}
+	for i, unit := range expected {
+		actual := uint16(data[1+i*2]) | uint16(data[2+i*2])<<8
+		if actual != unit {
+			t.Fatalf("unit %d: expected %#04x, got %#04x", i, unit, actual)
+		}
+	}
+
+	decoded, err := DecodeDirectoryClusterEntry(data)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(utf16.Decode(decoded.longName)) != "a😀" {
+		t.Fatalf("bad name: %v", decoded.longName)
+	}
+}
+
+func TestDirectory_NTCaseFlags(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		name  string
+		lfn   bool
+		flags uint8
+	}{
+		{"readme.txt", false, NTLowerBase | NTLowerExt},
+		{"MAKEFILE.am", false, NTLowerExt},
+		{"notes", false, NTLowerBase},
+		{"UPPER.TXT", false, 0},
+		{"Mixed.txt", true, 0},
+		{".ab", true, 0},
+		{".bashrc", true, 0},
+	}
+
+	for _, c := range cases {
+		entry, err := rootDir.AddFile(c.name)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		raw := entry.(*DirectoryEntry)
+		if (len(raw.lfnEntries) > 0) != c.lfn || raw.entry.ntCase != c.flags {
+			t.Fatalf("%s: lfn=%d flags=%#02x", c.name, len(raw.lfnEntries), raw.entry.ntCase)
+		}
+		if strings.TrimSpace(raw.entry.name) == "" {
+			t.Fatalf("%s: blank short name base", c.name)
+		}
+	}
+
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	rootDir, err = fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, c := range cases {
+		entry := rootDir.Entry(c.name)
+		if entry == nil || entry.Name() != c.name {
+			t.Fatalf("%s: not found after reopening", c.name)
+		}
+	}
+
+	if short := rootDir.Entry("readme.txt").ShortName(); short != "README.TXT" {
+		t.Fatalf("bad short name: %q", short)
+	}
+}
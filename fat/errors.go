@@ -0,0 +1,68 @@
+package fat
+
+import (
+	"errors"
+	"io/fs"
+
+	"github.com/rstms/ffs"
+)
+
+// Sentinel errors returned by this package. The ones with an io/fs
+// counterpart wrap it, so errors.Is(err, fs.ErrNotExist) and friends
+// work as expected. ErrReadOnly wraps ffs.ErrReadOnly, so that
+// errors.Is(err, ffs.ErrReadOnly) matches a write refused by either the
+// filesystem or the device.
+var (
+	ErrNotExist = &sentinelError{"file does not exist", fs.ErrNotExist}
+	ErrExist    = &sentinelError{"file already exists", fs.ErrExist}
+	ErrReadOnly = &sentinelError{"read-only filesystem", ffs.ErrReadOnly}
+	ErrClosed   = &sentinelError{"filesystem closed", fs.ErrClosed}
+	ErrNoSpace  = errors.New("no space left on device")
+	ErrNotDir   = errors.New("not a directory")
+	ErrIsDir    = errors.New("is a directory")
+	ErrNotEmpty = errors.New("directory not empty")
+	ErrCorrupt  = errors.New("filesystem corrupt")
+	ErrCodePage = &sentinelError{"unsupported code page", fs.ErrInvalid}
+)
+
+// ErrInvalidName is wrapped by the errors returned for names that break
+// one of the FAT/VFAT naming rules, see ValidateName.
+var ErrInvalidName = &sentinelError{"invalid file name", fs.ErrInvalid}
+
+var (
+	ErrNameEmpty        = &sentinelError{"file name is empty", ErrInvalidName}
+	ErrNameTooLong      = &sentinelError{"file name too long", ErrInvalidName}
+	ErrNameEncoding     = &sentinelError{"file name is not valid UTF-8", ErrInvalidName}
+	ErrNameControlChar  = &sentinelError{"file name contains a control character", ErrInvalidName}
+	ErrNameIllegalChar  = &sentinelError{"file name contains an illegal character", ErrInvalidName}
+	ErrNameTrailingChar = &sentinelError{"file name ends with a dot or space", ErrInvalidName}
+	ErrNameReserved     = &sentinelError{"file name is reserved", ErrInvalidName}
+)
+
+// ErrBadSystemArea is returned for bad blocks in the boot sector, the
+// FATs or the FAT12/FAT16 root directory. Unlike bad clusters they can't
+// be kept out of use, so the volume can't live on the device.
+var ErrBadSystemArea = errors.New("bad block in the system area")
+
+// ErrRootDirFull is returned when a new entry does not fit into the
+// fixed-size root directory of a FAT12/FAT16 filesystem.
+var ErrRootDirFull = &sentinelError{"root directory full", ErrNoSpace}
+
+// PathError records an error and the operation and file path that
+// caused it. It is the io/fs type, so callers can use errors.As with
+// either name.
+type PathError = fs.PathError
+
+// sentinelError is a sentinel error that wraps a more general one.
+type sentinelError struct {
+	msg string
+	err error
+}
+
+func (e *sentinelError) Error() string {
+	return e.msg
+}
+
+func (e *sentinelError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,64 @@
+package fat
+
+// Extent is a run of contiguous clusters backing a file. Offset is the
+// byte offset of the first cluster on the device of the filesystem,
+// which for a volume on a partition is the partition, not the disk.
+// Length covers whole clusters, so the last extent of a file may extend
+// beyond its size.
+type Extent struct {
+	Cluster uint32
+	Offset  int64
+	Length  int64
+}
+
+// FileExtents returns the runs of contiguous clusters holding the named
+// file or directory in chain order. A file without clusters has no
+// extents, nor has the FAT12/16 root directory, which lives outside the
+// data region.
+func (f *FileSystem) FileExtents(name string) ([]Extent, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	_, entry, err := f.lookup("extents", name)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	var start uint32
+	if entry != nil {
+		start = entry.entry.cluster
+	} else if !f.rootDir.fat16Root {
+		start = f.rootDir.startCluster
+	}
+
+	extents, err := f.extents(start)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return extents, nil
+}
+
+func (f *FileSystem) extents(start uint32) ([]Extent, error) {
+	chain, err := f.fat.Chain(start)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	bpc := int64(f.bs.BytesPerCluster())
+	extents := []Extent{}
+	for i, cluster := range chain {
+		if i > 0 && cluster == chain[i-1]+1 {
+			extents[len(extents)-1].Length += bpc
+			continue
+		}
+
+		extents = append(extents, Extent{
+			Cluster: cluster,
+			Offset:  int64(f.bs.ClusterOffset(int(cluster))),
+			Length:  bpc,
+		})
+	}
+
+	return extents, nil
+}
@@ -0,0 +1,66 @@
+package fat
+
+import (
+	"testing"
+)
+
+func TestFileSystem_FileExtents(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	a, err := fatFs.Create("a.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := fatFs.Create("b.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Both files get a cluster when created, so a.bin grows past b.bin
+	if _, err := b.Write(make([]byte, 512)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := a.Write(make([]byte, 1124)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	extents, err := fatFs.FileExtents("a.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(extents) != 2 || extents[0].Length != 512 || extents[1].Length != 1024 {
+		t.Fatalf("bad extents %+v", extents)
+	}
+
+	sectors, err := fatFs.FileSectors("a.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if extents[0].Offset != int64(sectors[0])*512 || extents[1].Offset != int64(sectors[1])*512 {
+		t.Fatalf("extents %+v don't match sectors %v", extents, sectors)
+	}
+	if extents[1].Cluster != extents[0].Cluster+2 {
+		t.Fatalf("bad clusters %+v", extents)
+	}
+
+	if _, err := fatFs.PinFile("a.bin"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	extents, err = fatFs.FileExtents("a.bin")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(extents) != 1 || extents[0].Length != 3*512 {
+		t.Fatalf("bad extents after pinning %+v", extents)
+	}
+
+	// The FAT12 root directory isn't in the data region
+	extents, err = fatFs.FileExtents("/")
+	if err != nil || len(extents) != 0 {
+		t.Fatalf("expected no extents, got %+v: %v", extents, err)
+	}
+
+	if _, err := fatFs.FileExtents("missing"); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
@@ -21,18 +21,29 @@ func DecodeFAT(device ffs.BlockDevice, bs *BootSectorCommon, n int) (*FAT, error
 		return nil, Fatalf("FAT #%d greater than total FATs: %d", n, bs.NumFATs)
 	}
 
-	data := make([]byte, bs.SectorsPerFat*uint32(bs.BytesPerSector))
+	// Don't trust the boot sector to size the buffer
+	size := int64(bs.SectorsPerFat) * int64(bs.BytesPerSector)
+	if int64(bs.FATOffset(n))+size > device.Len() {
+		return nil, Fatalf("FAT #%d extends past the end of the device: %w", n, ErrCorrupt)
+	}
+
+	data := make([]byte, size)
 	if _, err := device.ReadAt(data, int64(bs.FATOffset(n))); err != nil {
 		return nil, Fatal(err)
 	}
 
+	entryCount, err := FATEntryCount(bs)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
 	result := &FAT{
 		bs:      bs,
-		entries: make([]uint32, FATEntryCount(bs)),
+		entries: make([]uint32, entryCount),
 	}
 
 	fatType := bs.FATType()
-	for i := 0; i < int(FATEntryCount(bs)); i++ {
+	for i := 0; i < int(entryCount); i++ {
 		var entryData uint32
 		switch fatType {
 		case FAT12:
@@ -51,9 +62,14 @@ func DecodeFAT(device ffs.BlockDevice, bs *BootSectorCommon, n int) (*FAT, error
 
 // NewFAT creates a new FAT data structure, properly initialized.
 func NewFAT(bs *BootSectorCommon) (*FAT, error) {
+	entryCount, err := FATEntryCount(bs)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
 	result := &FAT{
 		bs:      bs,
-		entries: make([]uint32, FATEntryCount(bs)),
+		entries: make([]uint32, entryCount),
 	}
 
 	// Set the initial two entries according to spec
@@ -88,14 +104,9 @@ func (f *FAT) AllocChain() (uint32, error) {
 }
 
 func (f *FAT) allocNew() (uint32, error) {
-	dataSize := (f.bs.TotalSectors * uint32(f.bs.BytesPerSector))
-	dataSize -= f.bs.DataOffset()
-	clusterCount := dataSize / f.bs.BytesPerCluster()
-	lastClusterIndex := clusterCount + FirstCluster
-
 	var availIdx uint32
 	found := false
-	for i := uint32(FirstCluster); i < lastClusterIndex; i++ {
+	for i := uint32(FirstCluster); i < f.clusterLimit(); i++ {
 		if f.entries[i] == 0 {
 			availIdx = i
 			found = true
@@ -104,7 +115,7 @@ func (f *FAT) allocNew() (uint32, error) {
 	}
 
 	if !found {
-		return 0, Fatalf("FAT FULL")
+		return 0, Fatal(ErrNoSpace)
 	}
 
 	// Mark that this is now in use
@@ -113,27 +124,103 @@ func (f *FAT) allocNew() (uint32, error) {
 	return availIdx, nil
 }
 
+// AllocContiguous allocates a chain of count clusters that follow each
+// other on the disk and returns the first one.
+func (f *FAT) AllocContiguous(count int) (uint32, error) {
+	if count < 1 {
+		return 0, Fatalf("cannot allocate %d clusters", count)
+	}
+
+	run := 0
+	for i := uint32(FirstCluster); i < f.clusterLimit(); i++ {
+		if f.entries[i] != 0 {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == count {
+			start := i - uint32(count) + 1
+			f.linkRun(start, count)
+			return start, nil
+		}
+	}
+
+	return 0, Fatal(ErrNoSpace)
+}
+
+// allocRun allocates the count clusters starting at start as a chain.
+// It fails if any of them is in use.
+func (f *FAT) allocRun(start uint32, count int) error {
+	if count < 1 || start < FirstCluster || uint64(start)+uint64(count) > uint64(f.clusterLimit()) {
+		return Fatalf("clusters %d to %d outside the data region", start, int(start)+count-1)
+	}
+
+	for i := start; i < start+uint32(count); i++ {
+		if f.entries[i] != 0 {
+			return Fatalf("cluster %d in use: %w", i, ErrNoSpace)
+		}
+	}
+
+	f.linkRun(start, count)
+	return nil
+}
+
+// linkRun links count clusters starting at start into a chain.
+func (f *FAT) linkRun(start uint32, count int) {
+	for i := start; i < start+uint32(count)-1; i++ {
+		f.entries[i] = i + 1
+	}
+
+	f.entries[start+uint32(count)-1] = 0xFFFFFFFF & f.entryMask()
+}
+
 // Chain returns the chain of clusters starting at a certain cluster.
-func (f *FAT) Chain(start uint32) []uint32 {
+// A start cluster of 0 is an empty chain. A chain that leaves the data
+// area, runs into a free or bad cluster, or loops back on itself is
+// reported as ErrCorrupt.
+func (f *FAT) Chain(start uint32) ([]uint32, error) {
+	if start == 0 {
+		return []uint32{}, nil
+	}
+
+	limit := f.clusterLimit()
 	chain := make([]uint32, 0, 2)
 
 	cluster := start
 	for {
+		if cluster < FirstCluster || cluster >= limit {
+			return nil, Fatalf("cluster %d in chain starting at %d out of range: %w", cluster, start, ErrCorrupt)
+		}
+
+		// A chain can't be longer than the number of clusters
+		if uint32(len(chain)) >= limit-FirstCluster {
+			return nil, Fatalf("cluster chain starting at %d has a cycle: %w", start, ErrCorrupt)
+		}
+
 		chain = append(chain, cluster)
 		cluster = f.entries[cluster]
 
-		if f.isEofCluster(cluster) || cluster == 0 {
+		if f.isEofCluster(cluster) {
 			break
 		}
 	}
 
-	return chain
+	return chain, nil
 }
 
 // ResizeChain takes a given cluster number and resizes the chain
 // to the given length. It returns the new chain of clusters.
 func (f *FAT) ResizeChain(start uint32, length int) ([]uint32, error) {
-	chain := f.Chain(start)
+	chain, err := f.Chain(start)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if len(chain) == 0 {
+		return nil, Fatalf("cannot resize the empty chain: %w", ErrCorrupt)
+	}
+
 	if len(chain) == length {
 		return chain, nil
 	}
@@ -161,10 +248,38 @@ func (f *FAT) ResizeChain(start uint32, length int) ([]uint32, error) {
 			lastCluster = newCluster
 		}
 	} else {
-		panic("making chains smaller not implemented yet")
+		if length < 1 {
+			return nil, Fatalf("cannot shrink a chain to %d clusters", length)
+		}
+
+		// Terminate the chain early and free the rest of it
+		f.entries[chain[length-1]] = 0xFFFFFFFF & f.entryMask()
+		for _, cluster := range chain[length:] {
+			f.entries[cluster] = 0
+		}
+	}
+
+	chain, err = f.Chain(start)
+	if err != nil {
+		return nil, Fatal(err)
 	}
 
-	return f.Chain(start), nil
+	return chain, nil
+}
+
+// FreeChain marks every cluster in the chain starting at the given
+// cluster as free.
+func (f *FAT) FreeChain(start uint32) error {
+	chain, err := f.Chain(start)
+	if err != nil {
+		return Fatal(err)
+	}
+
+	for _, cluster := range chain {
+		f.entries[cluster] = 0
+	}
+
+	return nil
 }
 
 func (f *FAT) WriteToDevice(device ffs.BlockDevice) error {
@@ -194,6 +309,54 @@ func (f *FAT) isEofCluster(cluster uint32) bool {
 	return cluster >= (0xFFFFFF8 & f.entryMask())
 }
 
+// stateBits returns the bits of FAT entry 1 that are set on a clean
+// shutdown and while no hard error has occurred. FAT12 has neither.
+func (f *FAT) stateBits() (clean, noError uint32) {
+	switch f.bs.FATType() {
+	case FAT16:
+		return 0x8000, 0x4000
+	case FAT32:
+		return 0x08000000, 0x04000000
+	}
+
+	return 0, 0
+}
+
+// Dirty returns true if the volume is marked as not cleanly shut down.
+func (f *FAT) Dirty() bool {
+	clean, _ := f.stateBits()
+	return clean != 0 && f.entries[1]&clean == 0
+}
+
+// HardError returns true if the volume is marked as having had a disk
+// I/O error.
+func (f *FAT) HardError() bool {
+	_, noError := f.stateBits()
+	return noError != 0 && f.entries[1]&noError == 0
+}
+
+// setDirty sets or clears the dirty mark and returns true if it changed.
+func (f *FAT) setDirty(dirty bool) bool {
+	clean, _ := f.stateBits()
+	if clean == 0 || f.Dirty() == dirty {
+		return false
+	}
+
+	f.entries[1] ^= clean
+	return true
+}
+
+// clusterLimit returns one past the highest cluster number that can be
+// used, which is bounded by both the data area and the size of the FAT.
+func (f *FAT) clusterLimit() uint32 {
+	limit := f.bs.ClusterCount() + FirstCluster
+	if limit > uint32(len(f.entries)) {
+		limit = uint32(len(f.entries))
+	}
+
+	return limit
+}
+
 func (f *FAT) writeEntry12(data []byte, idx int, entry uint32) {
 	dataIdx := idx + (idx / 2)
 	data = data[dataIdx : dataIdx+2]
@@ -225,7 +388,7 @@ func (f *FAT) writeEntry32(data []byte, idx int, entry uint32) {
 
 // FATEntryCount returns the number of entries per fat for the given
 // boot sector.
-func FATEntryCount(bs *BootSectorCommon) uint32 {
+func FATEntryCount(bs *BootSectorCommon) (uint32, error) {
 	// Determine the number of entries that'll go in the FAT.
 	var entryCount uint32 = bs.SectorsPerFat * uint32(bs.BytesPerSector)
 	switch bs.FATType() {
@@ -236,16 +399,16 @@ func FATEntryCount(bs *BootSectorCommon) uint32 {
 	case FAT32:
 		entryCount /= 4
 	default:
-		panic("impossible fat type")
+		return 0, Fatalf("unexpected FAT type %d: %w", bs.FATType(), ErrCorrupt)
 	}
 
-	return entryCount
+	return entryCount, nil
 }
 
 func fatReadEntry12(data []byte, idx int) uint32 {
-	idx += idx / 2
+	dataIdx := idx + (idx / 2)
 
-	var result uint32 = (uint32(data[idx+1]) << 8) | uint32(data[idx])
+	var result uint32 = (uint32(data[dataIdx+1]) << 8) | uint32(data[dataIdx])
 	if idx%2 == 0 {
 		return result & 0xFFF
 	} else {
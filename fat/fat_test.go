@@ -0,0 +1,18 @@
+package fat
+
+import (
+	"testing"
+)
+
+func TestFatReadEntry12(t *testing.T) {
+	// Entries 0 to 3 are 0xFF0, 0xFFF, 0x123 and 0x456, packed two in
+	// three bytes with the odd entry in the high nibbles
+	data := []byte{0xF0, 0xFF, 0xFF, 0x23, 0x61, 0x45}
+
+	expected := []uint32{0xFF0, 0xFFF, 0x123, 0x456}
+	for i, value := range expected {
+		if got := fatReadEntry12(data, i); got != value {
+			t.Fatalf("entry %d: expected %#03x, got %#03x", i, value, got)
+		}
+	}
+}
@@ -1,16 +1,75 @@
 package fat
 
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
 type File struct {
 	chain *ClusterChain
 	dir   *Directory
 	entry *DirectoryClusterEntry
+	name  string
+
+	// flag holds the os.O_* flags the file was opened with
+	flag int
 }
 
 func (f *File) Read(p []byte) (n int, err error) {
+	f.dir.fs.lock.RLock()
+	defer f.dir.fs.lock.RUnlock()
+
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, Fatal(&PathError{Op: "read", Path: f.name, Err: fs.ErrPermission})
+	}
+
+	// The last cluster of the chain is only used up to the file size
+	if f.chain.readOffset >= f.entry.fileSize {
+		return 0, io.EOF
+	}
+
+	if remain := f.entry.fileSize - f.chain.readOffset; uint32(len(p)) > remain {
+		p = p[:remain]
+	}
+
 	return f.chain.Read(p)
 }
 
 func (f *File) Write(p []byte) (n int, err error) {
+	f.dir.fs.lock.Lock()
+	defer f.dir.fs.lock.Unlock()
+
+	if err := f.dir.fs.checkWritable("write", f.name); err != nil {
+		return 0, Fatal(err)
+	}
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, Fatal(&PathError{Op: "write", Path: f.name, Err: fs.ErrPermission})
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		f.chain.writeOffset = f.entry.fileSize
+	}
+
+	if f.entry.cluster == 0 {
+		// Empty files written by other implementations have no cluster
+		cluster, err := f.dir.fat.AllocChain()
+		if err != nil {
+			return 0, Fatal(err)
+		}
+
+		if err := f.dir.fat.WriteToDevice(f.dir.device); err != nil {
+			return 0, Fatal(err)
+		}
+
+		f.entry.cluster = cluster
+		f.chain.startCluster = cluster
+		if err := f.dir.dirCluster.WriteToDevice(f.dir.device, f.dir.fat); err != nil {
+			return 0, Fatal(err)
+		}
+	}
+
 	lastByte := f.chain.writeOffset + uint32(len(p))
 	if lastByte > f.entry.fileSize {
 		// Increase the file size since we're writing past the end of the file
@@ -25,6 +84,26 @@ func (f *File) Write(p []byte) (n int, err error) {
 	return f.chain.Write(p)
 }
 
+// truncate empties the file, keeping only its first cluster.
+func (f *File) truncate() error {
+	if f.entry.cluster != 0 {
+		if _, err := f.dir.fat.ResizeChain(f.entry.cluster, 1); err != nil {
+			return Fatal(err)
+		}
+
+		if err := f.dir.fat.WriteToDevice(f.dir.device); err != nil {
+			return Fatal(err)
+		}
+	}
+
+	f.entry.fileSize = 0
+	if err := f.dir.dirCluster.WriteToDevice(f.dir.device, f.dir.fat); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
 func (f *File) Close() error {
 	return nil
 }
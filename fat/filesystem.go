@@ -1,25 +1,105 @@
 package fat
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/rstms/ffs"
 	"strings"
+	"sync"
+	"time"
 )
 
 // FileSystem is the implementation of ffs.FileSystem that can read a
 // FAT filesystem.
+//
+// A FileSystem and the directories, entries and files obtained from it
+// are safe for concurrent use: any number of goroutines may read at the
+// same time, while operations that modify the filesystem (adding files
+// and directories, writing to files, changing attributes) are serialised
+// by a single filesystem-wide lock. An individual File handle keeps its
+// own read and write offsets and must not be shared between goroutines.
+//
+// A read-only FileSystem rejects every modifying call with ErrReadOnly
+// and never writes to the device, not even to update access dates.
+//
+// A writable FAT16/32 FileSystem marks the volume dirty in FAT entry 1
+// when it is opened and clean again when it is closed, so that a volume
+// left behind by a crashed writer can be told apart, see Dirty. Only
+// FAT entry 1 is kept: the FAT32 FSInfo sector and the dirty flag some
+// systems keep in the boot sector are left as they are.
 type FileSystem struct {
-	bs      *BootSectorCommon
-	device  ffs.BlockDevice
-	fat     *FAT
-	rootDir *DirectoryCluster
+	bs       *BootSectorCommon
+	device   ffs.BlockDevice
+	fat      *FAT
+	rootDir  *DirectoryCluster
+	readOnly bool
+	closed   bool
+	codePage CodePage
+
+	// dirty is true if the volume was marked dirty when opened
+	dirty bool
+
+	// lock guards the FAT, the directory clusters and the device
+	lock sync.RWMutex
+
+	// dirs holds every directory cluster decoded so far, keyed by
+	// its start cluster, so that all handles to a directory share
+	// the same entries. dirsLock guards the map itself, since it is
+	// filled in by readers holding only the read lock.
+	dirs     map[uint32]*DirectoryCluster
+	dirsLock sync.Mutex
 }
 
 var _ ffs.FileSystem = (*FileSystem)(nil)
 
+// Config is the configuration for opening a FileSystem.
+type Config struct {
+	// ReadOnly opens the filesystem read-only even if the device is
+	// writable.
+	ReadOnly bool
+
+	// CodePage is the OEM code page of short names and the volume
+	// label. Defaults to CP437.
+	CodePage CodePage
+}
+
 // New returns a new FileSystem for accessing a previously created
-// FAT filesystem.
+// FAT filesystem. If the device is an ffs.ReadOnlyDevice that refuses
+// writes, the FileSystem is read-only.
 func New(device ffs.BlockDevice) (*FileSystem, error) {
+	return NewWithConfig(device, nil)
+}
+
+// NewReadOnly returns a new read-only FileSystem for accessing a
+// previously created FAT filesystem, even if the device is writable.
+func NewReadOnly(device ffs.BlockDevice) (*FileSystem, error) {
+	return NewWithConfig(device, &Config{ReadOnly: true})
+}
+
+// NewWithConfig returns a new FileSystem for accessing a previously
+// created FAT filesystem with the given configuration. A nil config
+// uses the defaults.
+func NewWithConfig(device ffs.BlockDevice, config *Config) (*FileSystem, error) {
+	if config == nil {
+		config = &Config{}
+	}
+
+	readOnly := config.ReadOnly
+	if ro, ok := device.(ffs.ReadOnlyDevice); ok && ro.ReadOnly() {
+		readOnly = true
+	}
+
+	codePage := config.CodePage
+	if codePage == 0 {
+		codePage = CP437
+	}
+
+	if _, err := codePage.charmap(); err != nil {
+		return nil, Fatal(err)
+	}
+
 	bs, err := DecodeBootSector(device)
 	if err != nil {
 		return nil, Fatal(err)
@@ -45,26 +125,131 @@ func New(device ffs.BlockDevice) (*FileSystem, error) {
 	}
 
 	result := &FileSystem{
-		bs:      bs,
-		device:  device,
-		fat:     fat,
-		rootDir: rootDir,
+		bs:       bs,
+		device:   device,
+		fat:      fat,
+		rootDir:  rootDir,
+		readOnly: readOnly,
+		codePage: codePage,
+		dirty:    fat.Dirty(),
+		dirs:     make(map[uint32]*DirectoryCluster),
+	}
+
+	// ".." entries that refer to the root directory hold cluster 0
+	result.dirs[0] = rootDir
+	if !rootDir.fat16Root {
+		result.dirs[rootDir.startCluster] = rootDir
+	}
+
+	if !readOnly && fat.setDirty(true) {
+		if err := fat.WriteToDevice(device); err != nil {
+			return nil, Fatal(err)
+		}
 	}
 
 	return result, nil
 }
 
-func (f *FileSystem) RootDir() (ffs.Directory, error) {
-	dir := &Directory{
-		device:     f.device,
-		dirCluster: f.rootDir,
-		fat:        f.fat,
+// Close marks a writable volume clean. Every modifying call fails with
+// ErrClosed afterwards. It doesn't close the device.
+func (f *FileSystem) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return nil
+	}
+
+	f.closed = true
+	if f.readOnly {
+		return nil
+	}
+
+	if f.fat.setDirty(false) {
+		if err := f.fat.WriteToDevice(f.device); err != nil {
+			return Fatal(err)
+		}
 	}
 
-	return dir, nil
+	return nil
+}
+
+// Dirty returns true if the volume was marked dirty when it was opened:
+// a writer didn't close it cleanly.
+func (f *FileSystem) Dirty() bool {
+	return f.dirty
+}
+
+// HardError returns true if the volume is marked as having had a disk
+// I/O error.
+func (f *FileSystem) HardError() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.fat.HardError()
+}
+
+// CodePage returns the OEM code page of short names and the label.
+func (f *FileSystem) CodePage() CodePage {
+	return f.codePage
+}
+
+// ReadOnly returns true if the filesystem was opened without write
+// access. A closed filesystem rejects modifications with ErrClosed
+// instead.
+func (f *FileSystem) ReadOnly() bool {
+	return f.readOnly
+}
+
+// checkWritable returns ErrClosed or ErrReadOnly for the given operation
+// and path if the filesystem is closed or read-only.
+func (f *FileSystem) checkWritable(op, path string) error {
+	if f.closed {
+		return &PathError{Op: op, Path: path, Err: ErrClosed}
+	}
+
+	if f.readOnly {
+		return &PathError{Op: op, Path: path, Err: ErrReadOnly}
+	}
+
+	return nil
+}
+
+// dirCluster returns the shared DirectoryCluster that starts at the
+// given cluster, decoding it from the device on first use.
+func (f *FileSystem) dirCluster(startCluster uint32) (*DirectoryCluster, error) {
+	f.dirsLock.Lock()
+	defer f.dirsLock.Unlock()
+
+	if dirCluster, ok := f.dirs[startCluster]; ok {
+		return dirCluster, nil
+	}
+
+	dirCluster, err := DecodeDirectoryCluster(startCluster, f.device, f.fat)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	f.dirs[startCluster] = dirCluster
+	return dirCluster, nil
+}
+
+// addDirCluster registers a newly created DirectoryCluster.
+func (f *FileSystem) addDirCluster(dirCluster *DirectoryCluster) {
+	f.dirsLock.Lock()
+	defer f.dirsLock.Unlock()
+
+	f.dirs[dirCluster.startCluster] = dirCluster
+}
+
+func (f *FileSystem) RootDir() (ffs.Directory, error) {
+	return f.root(), nil
 }
 
 func (f *FileSystem) Info() (map[string]any, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
 	var ret map[string]any
 	bs, err := DecodeBootSector(f.device)
 	if err != nil {
@@ -78,10 +263,16 @@ func (f *FileSystem) Info() (map[string]any, error) {
 	if err != nil {
 		return ret, Fatal(err)
 	}
+	ret["BadClusters"] = f.fat.BadClusters()
+	ret["Dirty"] = f.dirty
+	ret["HardError"] = f.fat.HardError()
 	return ret, nil
 }
 
 func (f *FileSystem) FATType() (int, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
 	bs, err := DecodeBootSector(f.device)
 	if err != nil {
 		return 0, Fatal(err)
@@ -94,10 +285,13 @@ func (f *FileSystem) FATType() (int, error) {
 	case FAT32:
 		return 32, nil
 	}
-	return 0, Fatalf("unexpected FAT type")
+	return 0, Fatalf("unexpected FAT type: %w", ErrCorrupt)
 }
 
 func (f *FileSystem) OEMName() (string, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
 	bs, err := DecodeBootSector(f.device)
 	if err != nil {
 		return "", Fatal(err)
@@ -105,7 +299,16 @@ func (f *FileSystem) OEMName() (string, error) {
 	return bs.OEMName, nil
 }
 
+// VolumeLabel returns the volume label. Like Windows, it prefers the
+// volume ID entry in the root directory over the boot sector copy.
 func (f *FileSystem) VolumeLabel() (string, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if entry := f.volumeEntry(); entry != nil {
+		return f.codePage.Decode(strings.TrimRight(entry.volumeLabel(), " ")), nil
+	}
+
 	bs, err := DecodeBootSector(f.device)
 	if err != nil {
 		return "", Fatal(err)
@@ -114,5 +317,275 @@ func (f *FileSystem) VolumeLabel() (string, error) {
 	if err != nil {
 		return "", Fatal(err)
 	}
-	return strings.TrimSpace(label), nil
+	label = strings.TrimRight(label, " \x00")
+	if label == "NO NAME" {
+		// Written by formatters for volumes without a label
+		return "", nil
+	}
+	return f.codePage.Decode(label), nil
+}
+
+// volumeEntry returns the volume ID entry of the root directory, or nil
+// if there is none.
+func (f *FileSystem) volumeEntry() *DirectoryClusterEntry {
+	for _, entry := range f.rootDir.entries {
+		if !entry.deleted && entry.IsVolumeId() {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// SetVolumeLabel changes the volume label in both the boot sector and
+// the root directory. An empty label removes it.
+func (f *FileSystem) SetVolumeLabel(label string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("setlabel", label); err != nil {
+		return Fatal(err)
+	}
+
+	raw, err := f.encodeVolumeLabel(label)
+	if err != nil {
+		return Fatal(&PathError{Op: "setlabel", Path: label, Err: err})
+	}
+
+	// The root directory entry first, it is the one that can fail
+	entry := f.volumeEntry()
+	switch {
+	case label == "" && entry != nil:
+		entry.deleted = true
+	case label == "":
+	case entry != nil:
+		*entry = *newVolumeEntry(raw, time.Now())
+	default:
+		slot := f.rootDir.freeSlot(1)
+		if slot < 0 && !f.rootDir.hasRoomFor(1, f.bs) {
+			return Fatal(ErrRootDirFull)
+		}
+
+		entry = newVolumeEntry(raw, time.Now())
+		if slot >= 0 {
+			f.rootDir.entries[slot] = entry
+		} else {
+			f.rootDir.entries = append(f.rootDir.entries, entry)
+		}
+	}
+
+	if err := f.rootDir.WriteToDevice(f.device, f.fat); err != nil {
+		return Fatal(err)
+	}
+
+	if label == "" {
+		// The boot sector field can't be empty
+		raw = "NO NAME    "
+	}
+
+	err = f.updateBootSector(func(sector []byte) error {
+		offset, err := bootSignatureOffset(f.bs.FATType())
+		if err != nil {
+			return Fatal(err)
+		}
+
+		// Only the extended boot record has a label
+		if sector[offset] == extendedBootSignature {
+			copy(sector[offset+5:offset+16], raw)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// encodeVolumeLabel validates a label and returns it in OEM bytes,
+// padded with spaces to 11 bytes. Labels follow the short name rules,
+// except that spaces are allowed and dots are not, and are upper-cased
+// like short names before they are encoded in the code page.
+func (f *FileSystem) encodeVolumeLabel(label string) (string, error) {
+	for _, char := range label {
+		if char < 0x20 {
+			return "", ErrNameControlChar
+		}
+
+		if strings.ContainsRune(illegalLabelChars, char) {
+			return "", fmt.Errorf("character %q: %w", char, ErrNameIllegalChar)
+		}
+	}
+
+	raw, err := f.codePage.Encode(strings.ToUpper(label))
+	if err != nil {
+		return "", err
+	}
+
+	if len(raw) > 11 {
+		return "", ErrNameTooLong
+	}
+
+	return raw + strings.Repeat(" ", 11-len(raw)), nil
+}
+
+// SetOEMName changes the OEM name in the boot sector. It must be at most
+// eight printable ASCII characters.
+func (f *FileSystem) SetOEMName(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("setoem", name); err != nil {
+		return Fatal(err)
+	}
+
+	if len(name) > 8 {
+		return Fatal(&PathError{Op: "setoem", Path: name, Err: ErrNameTooLong})
+	}
+
+	for _, char := range name {
+		if char < 0x20 || char > 0x7E {
+			return Fatal(&PathError{Op: "setoem", Path: name, Err: ErrNameIllegalChar})
+		}
+	}
+
+	err := f.updateBootSector(func(sector []byte) error {
+		copy(sector[3:11], name+strings.Repeat(" ", 8-len(name)))
+		return nil
+	})
+	if err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// VolumeID returns the volume serial number from the boot sector.
+func (f *FileSystem) VolumeID() (uint32, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var id uint32
+	err := f.readBootSector(func(sector []byte) error {
+		offset, err := f.volumeIDOffset(sector)
+		if err != nil {
+			return Fatal(err)
+		}
+
+		id = binary.LittleEndian.Uint32(sector[offset : offset+4])
+		return nil
+	})
+	if err != nil {
+		return 0, Fatal(err)
+	}
+
+	return id, nil
+}
+
+// SetVolumeID changes the volume serial number in the boot sector.
+func (f *FileSystem) SetVolumeID(id uint32) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("setid", ""); err != nil {
+		return Fatal(err)
+	}
+
+	err := f.updateBootSector(func(sector []byte) error {
+		offset, err := f.volumeIDOffset(sector)
+		if err != nil {
+			return Fatal(err)
+		}
+
+		binary.LittleEndian.PutUint32(sector[offset:offset+4], id)
+		return nil
+	})
+	if err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// BootCode returns the jump and the whole boot code area of the boot
+// sector.
+func (f *FileSystem) BootCode() (*BootCode, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var code *BootCode
+	err := f.readBootSector(func(sector []byte) error {
+		code = decodeBootCode(sector, f.bs.FATType())
+		return nil
+	})
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return code, nil
+}
+
+// SetBootCode installs boot code in the boot sector. The BIOS parameter
+// block is preserved and the rest of the boot code area is zeroed.
+func (f *FileSystem) SetBootCode(code *BootCode) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("setbootcode", ""); err != nil {
+		return Fatal(err)
+	}
+
+	err := f.updateBootSector(func(sector []byte) error {
+		return code.put(sector, bootCodeOffset(f.bs.FATType()))
+	})
+	if err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// volumeIDOffset returns the offset of BS_VolID in the boot sector.
+func (f *FileSystem) volumeIDOffset(sector []byte) (int, error) {
+	offset, err := bootSignatureOffset(f.bs.FATType())
+	if err != nil {
+		return 0, Fatal(err)
+	}
+
+	switch sector[offset] {
+	case extendedBootSignature, extendedBootSignatureOld:
+		return offset + 1, nil
+	}
+
+	return 0, Fatalf("boot sector has no volume ID: %w", errors.ErrUnsupported)
+}
+
+// readBootSector calls read with the boot sector.
+func (f *FileSystem) readBootSector(read func(sector []byte) error) error {
+	sector := make([]byte, f.bs.BytesPerSector)
+	if _, err := f.device.ReadAt(sector, 0); err != nil {
+		return Fatal(err)
+	}
+
+	return read(sector)
+}
+
+// updateBootSector reads the boot sector, lets update modify it and
+// writes it back.
+func (f *FileSystem) updateBootSector(update func(sector []byte) error) error {
+	sector := make([]byte, f.bs.BytesPerSector)
+	if _, err := f.device.ReadAt(sector, 0); err != nil {
+		return Fatal(err)
+	}
+
+	if err := update(sector); err != nil {
+		return Fatal(err)
+	}
+
+	if _, err := f.device.WriteAt(sector, 0); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
 }
@@ -1,9 +1,15 @@
 package fat
 
 import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/rstms/ffs"
+	"github.com/rstms/ffs/internal/testdisk"
 )
 
 func TestFileSystemImplementsFileSystem(t *testing.T) {
@@ -13,3 +19,308 @@ func TestFileSystemImplementsFileSystem(t *testing.T) {
 		t.Fatal("FileSystem should be a FileSystem")
 	}
 }
+
+// newTestFloppy formats a 1.44MB FAT12 floppy backed by a temporary
+// file and returns the device and the opened filesystem.
+func newTestFloppy(t *testing.T) (ffs.BlockDevice, *FileSystem) {
+	floppyF, err := os.Create(filepath.Join(t.TempDir(), "floppy.img"))
+	if err != nil {
+		t.Fatalf("Error creating temporary file for floppy: %s", err)
+	}
+	t.Cleanup(func() { floppyF.Close() })
+
+	if err := floppyF.Truncate(1440 * 1024); err != nil {
+		t.Fatalf("Error creating floppy: %s", err)
+	}
+
+	device, err := ffs.NewFileDisk(floppyF)
+	if err != nil {
+		t.Fatalf("Error creating floppy: %s", err)
+	}
+
+	formatConfig := &SuperFloppyConfig{
+		FATType: FAT12,
+		Label:   "ffs",
+		OEMName: "ffs",
+	}
+	if err := FormatSuperFloppy(device, formatConfig); err != nil {
+		t.Fatalf("Error formatting floppy: %s", err)
+	}
+
+	fatFs, err := New(device)
+	if err != nil {
+		t.Fatalf("Error opening floppy: %s", err)
+	}
+
+	return device, fatFs
+}
+
+func TestFileSystem_ReadOnly(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	entry, err := rootDir.AddFile("HELLO.TXT")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	file, err := entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := file.Write([]byte("hello")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fatFs, err = NewReadOnly(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !fatFs.ReadOnly() {
+		t.Fatal("filesystem should be read-only")
+	}
+	rootDir, err = fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entry = rootDir.Entry("HELLO.TXT")
+	if entry == nil {
+		t.Fatal("HELLO.TXT not found")
+	}
+	file, err = entry.File()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data := make([]byte, 5)
+	if _, err := file.Read(data); err != nil || string(data) != "hello" {
+		t.Fatalf("read failed: %q %v", data, err)
+	}
+
+	checks := map[string]error{}
+	_, checks["AddFile"] = rootDir.AddFile("NEW.TXT")
+	_, checks["AddDirectory"] = rootDir.AddDirectory("NEWDIR")
+	_, checks["Write"] = file.Write([]byte("x"))
+	checks["SetAttr"] = entry.SetAttr(ffs.AttrHidden, true)
+	for name, err := range checks {
+		if !errors.Is(err, ErrReadOnly) || !errors.Is(err, ffs.ErrReadOnly) || !errors.Is(err, fs.ErrPermission) {
+			t.Fatalf("%s: expected ErrReadOnly, got %v", name, err)
+		}
+	}
+}
+
+func TestFileSystem_VolumeLabel(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	if label, err := fatFs.VolumeLabel(); err != nil || label != "ffs" {
+		t.Fatalf("bad label %q: %v", label, err)
+	}
+
+	if err := fatFs.SetVolumeLabel("My Disk"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bootLabel, err := DecodeVolumeLabel(device, FAT12)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if bootLabel != "MY DISK    " {
+		t.Fatalf("bad boot sector label %q", bootLabel)
+	}
+	if label, err := fatFs.VolumeLabel(); err != nil || label != "MY DISK" {
+		t.Fatalf("bad label %q: %v", label, err)
+	}
+
+	// Windows shows the root directory entry
+	fatFs.volumeEntry().name = "OTHER"
+	if err := fatFs.rootDir.WriteToDevice(device, fatFs.fat); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if label, err := fatFs.VolumeLabel(); err != nil || label != "OTHER" {
+		t.Fatalf("bad label %q: %v", label, err)
+	}
+
+	if err := fatFs.SetVolumeLabel(""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if label, err := fatFs.VolumeLabel(); err != nil || label != "" {
+		t.Fatalf("bad label %q: %v", label, err)
+	}
+
+	// The deleted entry's slot is reused
+	entries := len(fatFs.rootDir.entries)
+	if err := fatFs.SetVolumeLabel("AGAIN"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(fatFs.rootDir.entries) != entries {
+		t.Fatal("volume entry should reuse the deleted slot")
+	}
+
+	for label, expected := range map[string]error{
+		"a.b":          ErrNameIllegalChar,
+		"twelve chars": ErrNameTooLong,
+		"ЖЖЖ":          ErrNameIllegalChar,
+	} {
+		if err := fatFs.SetVolumeLabel(label); !errors.Is(err, expected) {
+			t.Fatalf("%q: expected %v, got %v", label, expected, err)
+		}
+	}
+}
+
+func TestFileSystem_OEMNameAndVolumeID(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	if err := fatFs.SetOEMName("MSWIN4.1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := fatFs.SetOEMName("too long!"); !errors.Is(err, ErrNameTooLong) {
+		t.Fatalf("expected ErrNameTooLong, got %v", err)
+	}
+	if err := fatFs.SetVolumeID(0x1234ABCD); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fatFs, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if name, err := fatFs.OEMName(); err != nil || name != "MSWIN4.1" {
+		t.Fatalf("bad OEM name %q: %v", name, err)
+	}
+	if id, err := fatFs.VolumeID(); err != nil || id != 0x1234ABCD {
+		t.Fatalf("bad volume ID %#x: %v", id, err)
+	}
+}
+
+func TestFileSystem_BootCode(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	code, err := fatFs.BootCode()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if code.Jump != [3]byte{0xEB, 0x3C, 0x90} || len(code.Code) != BootCodeSize(FAT12) {
+		t.Fatalf("bad default boot code: % x", code.Jump)
+	}
+
+	var before [512]byte
+	if _, err := device.ReadAt(before[:], 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bootCode := &BootCode{Code: []byte{0xFA, 0x31, 0xC0, 0xCD, 0x19}}
+	if err := fatFs.SetBootCode(bootCode); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var after [512]byte
+	if _, err := device.ReadAt(after[:], 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(before[3:62], after[3:62]) || after[510] != 0x55 || after[511] != 0xAA {
+		t.Fatal("BIOS parameter block not preserved")
+	}
+	if after[62] != 0xFA || after[66] != 0x19 || after[67] != 0 {
+		t.Fatalf("bad boot code: % x", after[62:68])
+	}
+
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if code, err := fatFs.BootCode(); err != nil || code.Code[4] != 0x19 {
+		t.Fatalf("bad boot code %v: %v", code, err)
+	}
+
+	if err := fatFs.SetBootCode(&BootCode{Code: make([]byte, 449)}); err == nil {
+		t.Fatal("expected error for boot code too long")
+	}
+	if err := fatFs.SetBootCode(&BootCode{Jump: [3]byte{1, 2, 3}}); err == nil {
+		t.Fatal("expected error for invalid jump")
+	}
+
+	// Installed when formatting
+	formatConfig := &SuperFloppyConfig{
+		FATType:  FAT12,
+		BootCode: &BootCode{Jump: [3]byte{0xE9, 0x3B, 0x00}, Code: []byte{0xF4}},
+	}
+	if err := FormatSuperFloppy(device, formatConfig); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := device.ReadAt(after[:], 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if after[0] != 0xE9 || after[62] != 0xF4 {
+		t.Fatalf("bad boot sector: % x", after[:64])
+	}
+}
+
+func TestFileSystem_Dirty(t *testing.T) {
+	device := testdisk.New(make([]byte, 16*1024*1024))
+	if err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT16}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fatFs, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if fatFs.Dirty() {
+		t.Fatal("freshly formatted volume is dirty")
+	}
+
+	// A crashed writer leaves the volume marked dirty
+	crashed, err := NewReadOnly(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !crashed.Dirty() {
+		t.Fatal("open volume not marked dirty")
+	}
+	info, err := crashed.Info()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info["Dirty"] != true || info["HardError"] != false {
+		t.Fatalf("bad state in info: %v %v", info["Dirty"], info["HardError"])
+	}
+
+	if err := fatFs.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := fatFs.Create("late.txt"); !errors.Is(err, ErrClosed) || !errors.Is(err, fs.ErrClosed) {
+		t.Fatalf("expected ErrClosed after close, got %v", err)
+	}
+	if fatFs.ReadOnly() {
+		t.Fatal("closing made the filesystem read-only")
+	}
+	if err := fatFs.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	clean, err := NewReadOnly(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if clean.Dirty() || clean.HardError() {
+		t.Fatal("closed volume not marked clean")
+	}
+
+	// The hard error bit is cleared by the OS after an I/O error
+	clean.fat.entries[1] &^= 0x4000
+	if !clean.HardError() {
+		t.Fatal("hard error not reported")
+	}
+
+	// FAT12 has no room for the marks
+	_, fatFs = newTestFloppy(t)
+	if fatFs.Dirty() || fatFs.fat.entries[1] != 0xFFF {
+		t.Fatalf("FAT12 entry 1 changed to %#x", fatFs.fat.entries[1])
+	}
+}
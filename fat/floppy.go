@@ -0,0 +1,74 @@
+package fat
+
+import (
+	"strings"
+)
+
+// FloppyFormat is the geometry and BIOS parameter block of a standard
+// floppy disk format. See https://support.microsoft.com/en-us/kb/75131.
+type FloppyFormat struct {
+	// Names the format can be selected by, the first one is canonical.
+	Names []string
+
+	Media             MediaType
+	SectorsPerTrack   uint16
+	NumHeads          uint16
+	Tracks            uint16
+	SectorsPerCluster uint8
+	RootEntryCount    uint16
+	SectorsPerFat     uint32
+}
+
+// FloppyFormats are the standard FAT12 floppy disk formats.
+var FloppyFormats = []*FloppyFormat{
+	{[]string{"160K"}, 0xFE, 8, 1, 40, 1, 64, 1},
+	{[]string{"180K"}, 0xFC, 9, 1, 40, 1, 64, 2},
+	{[]string{"320K"}, 0xFF, 8, 2, 40, 2, 112, 1},
+	{[]string{"360K"}, 0xFD, 9, 2, 40, 2, 112, 2},
+	{[]string{"720K"}, 0xF9, 9, 2, 80, 2, 112, 3},
+	{[]string{"1.2M", "1200K"}, 0xF9, 15, 2, 80, 1, 224, 7},
+	{[]string{"1.44M", "1440K"}, 0xF0, 18, 2, 80, 1, 224, 9},
+	{[]string{"2.88M", "2880K"}, 0xF0, 36, 2, 80, 2, 240, 9},
+	{[]string{"DMF", "1.68M", "1680K"}, 0xF0, 21, 2, 80, 4, 16, 3},
+}
+
+// Name returns the canonical name of the format.
+func (f *FloppyFormat) Name() string {
+	return f.Names[0]
+}
+
+// TotalSectors returns the number of 512 byte sectors on the disk.
+func (f *FloppyFormat) TotalSectors() uint32 {
+	return uint32(f.SectorsPerTrack) * uint32(f.NumHeads) * uint32(f.Tracks)
+}
+
+// Size returns the size of the disk in bytes.
+func (f *FloppyFormat) Size() int64 {
+	return int64(f.TotalSectors()) * 512
+}
+
+// FloppyFormatByName returns the floppy format with the given name,
+// ignoring case.
+func FloppyFormatByName(name string) (*FloppyFormat, error) {
+	for _, format := range FloppyFormats {
+		for _, formatName := range format.Names {
+			if strings.EqualFold(formatName, name) {
+				return format, nil
+			}
+		}
+	}
+
+	return nil, Fatalf("unknown floppy format %q", name)
+}
+
+// FloppyFormatBySize returns the floppy format of the given size in
+// bytes, or nil if there is none.
+func FloppyFormatBySize(size int64) *FloppyFormat {
+	for _, format := range FloppyFormats {
+		if format.Size() == size {
+			return format
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package fat
+
+import (
+	"testing"
+
+	"github.com/rstms/ffs/internal/testdisk"
+)
+
+func TestFloppyFormats(t *testing.T) {
+	for _, floppy := range FloppyFormats {
+		device := testdisk.New(make([]byte, floppy.Size()))
+
+		formatConfig := &SuperFloppyConfig{
+			FATType: FAT12,
+			Label:   "ffs",
+			OEMName: "ffs",
+			Floppy:  floppy.Names[len(floppy.Names)-1],
+		}
+		if err := FormatSuperFloppy(device, formatConfig); err != nil {
+			t.Fatalf("%s: %s", floppy.Name(), err)
+		}
+
+		bs, err := DecodeBootSector(device)
+		if err != nil {
+			t.Fatalf("%s: %s", floppy.Name(), err)
+		}
+
+		if bs.Media != floppy.Media ||
+			bs.SectorsPerTrack != floppy.SectorsPerTrack ||
+			bs.NumHeads != floppy.NumHeads ||
+			bs.SectorsPerCluster != floppy.SectorsPerCluster ||
+			bs.RootEntryCount != floppy.RootEntryCount ||
+			bs.SectorsPerFat != floppy.SectorsPerFat ||
+			bs.TotalSectors != floppy.TotalSectors() {
+			t.Fatalf("%s: bad boot sector: %+v", floppy.Name(), bs)
+		}
+
+		// The media byte is repeated in the first FAT entry
+		var sector [512]byte
+		if _, err := device.ReadAt(sector[:], int64(bs.ReservedSectorCount)*512); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if sector[0] != byte(floppy.Media) {
+			t.Fatalf("%s: bad FAT media byte %#02x", floppy.Name(), sector[0])
+		}
+
+		fatFs, err := New(device)
+		if err != nil {
+			t.Fatalf("%s: %s", floppy.Name(), err)
+		}
+		if _, err := fatFs.Create("test.txt"); err != nil {
+			t.Fatalf("%s: %s", floppy.Name(), err)
+		}
+	}
+}
+
+func TestFloppyFormats_Errors(t *testing.T) {
+	if _, err := FloppyFormatByName("1.4M"); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+
+	if floppy, err := FloppyFormatByName("dmf"); err != nil || floppy.Size() != 1680*1024 {
+		t.Fatalf("bad format %v: %v", floppy, err)
+	}
+
+	if FloppyFormatBySize(1000*1024) != nil {
+		t.Fatal("expected no format for size")
+	}
+
+	device := testdisk.New(make([]byte, 1440*1024))
+	for _, formatConfig := range []*SuperFloppyConfig{
+		{FATType: FAT12, Floppy: "720K"},
+		{FATType: FAT16, Floppy: "1.44M"},
+		{FATType: FAT12, Floppy: "bogus"},
+	} {
+		if err := FormatSuperFloppy(device, formatConfig); err == nil {
+			t.Fatalf("expected error for %+v", formatConfig)
+		}
+	}
+}
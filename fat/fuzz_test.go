@@ -0,0 +1,159 @@
+package fat
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/rstms/ffs/internal/testdisk"
+)
+
+// fuzzSeedImage returns a small freshly formatted FAT12 image with a
+// few entries in it.
+func fuzzSeedImage(f *testing.F) []byte {
+	device := testdisk.New(make([]byte, 16*1024))
+	config := &SuperFloppyConfig{FATType: FAT12, Label: "FUZZ", OEMName: "ffs"}
+	if err := FormatSuperFloppy(device, config); err != nil {
+		f.Fatalf("err: %s", err)
+	}
+
+	fatFs, err := New(device)
+	if err != nil {
+		f.Fatalf("err: %s", err)
+	}
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		f.Fatalf("err: %s", err)
+	}
+	entry, err := rootDir.AddFile("a rather long file name.txt")
+	if err != nil {
+		f.Fatalf("err: %s", err)
+	}
+	file, err := entry.File()
+	if err != nil {
+		f.Fatalf("err: %s", err)
+	}
+	if _, err := file.Write(make([]byte, 3000)); err != nil {
+		f.Fatalf("err: %s", err)
+	}
+	if _, err := rootDir.AddDirectory("DIR"); err != nil {
+		f.Fatalf("err: %s", err)
+	}
+
+	return device.Data
+}
+
+func FuzzDecodeBootSector(f *testing.F) {
+	seed := fuzzSeedImage(f)
+	f.Add(seed[:512])
+	f.Add(make([]byte, 512))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 512 {
+			data = append(data, make([]byte, 512-len(data))...)
+		}
+
+		bs, err := DecodeBootSector(testdisk.New(data))
+		if err != nil {
+			return
+		}
+
+		// Everything derived from a decoded boot sector must be usable
+		bs.FATType()
+		bs.ClusterCount()
+		bs.DataOffset()
+		if _, err := FATEntryCount(bs); err != nil {
+			t.Fatalf("valid boot sector, invalid FAT entry count: %s", err)
+		}
+	})
+}
+
+func FuzzDecodeDirectoryClusterEntry(f *testing.F) {
+	seed := fuzzSeedImage(f)
+	bs, err := DecodeBootSector(testdisk.New(seed))
+	if err != nil {
+		f.Fatalf("err: %s", err)
+	}
+	root := seed[bs.RootDirOffset():]
+	for i := 0; i < 5; i++ {
+		f.Add(root[i*DirectoryEntrySize : (i+1)*DirectoryEntrySize])
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entry, err := DecodeDirectoryClusterEntry(data)
+		if err != nil {
+			return
+		}
+
+		entry.IsLong()
+		entry.IsVolumeId()
+		entry.Bytes()
+	})
+}
+
+func FuzzDecodeDirectoryCluster(f *testing.F) {
+	seed := fuzzSeedImage(f)
+	bs, err := DecodeBootSector(testdisk.New(seed))
+	if err != nil {
+		f.Fatalf("err: %s", err)
+	}
+	root := seed[bs.RootDirOffset():bs.DataOffset()]
+	f.Add(root)
+
+	// A subdirectory of many clusters, with more than 64 KB of entries
+	f.Add(bytes.Repeat(root[:3*DirectoryEntrySize], 700))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir, err := decodeDirectoryCluster(data, bs)
+		if err != nil {
+			return
+		}
+
+		for _, entry := range dir.entries {
+			entry.IsLong()
+			entry.IsVolumeId()
+			entry.Bytes()
+		}
+	})
+}
+
+func FuzzDecodeFAT(f *testing.F) {
+	f.Add(fuzzSeedImage(f))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		device := testdisk.New(data)
+		bs, err := DecodeBootSector(device)
+		if err != nil {
+			return
+		}
+
+		fat, err := DecodeFAT(device, bs, 0)
+		if err != nil {
+			return
+		}
+
+		// Walk every chain; corrupt ones must be errors, not panics
+		for i := uint32(0); i < uint32(len(fat.entries)) && i < 4096; i++ {
+			fat.Chain(i)
+		}
+
+		// Go through the whole stack on the same data
+		fatFs, err := New(device)
+		if err != nil {
+			return
+		}
+		rootDir, err := fatFs.RootDir()
+		if err != nil {
+			return
+		}
+		for _, entry := range rootDir.Entries() {
+			if entry.IsDir() {
+				entry.Dir()
+			} else if file, err := entry.File(); err == nil {
+				io.Copy(io.Discard, io.LimitReader(file, 1<<20))
+			}
+		}
+	})
+}
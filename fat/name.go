@@ -0,0 +1,137 @@
+package fat
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The characters that may not appear in a long name, in addition to
+// control characters.
+const illegalNameChars = `\/:*?"<>|`
+
+// The characters that may not appear in a volume label.
+const illegalLabelChars = illegalNameChars + `.,;+=[]`
+
+// reservedNames are the DOS device names. They can't be used as a file
+// name, with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ValidateName checks a single file name, not a path, against the
+// FAT/VFAT naming rules. The error wraps ErrInvalidName and the
+// sentinel error of the rule that was broken.
+func ValidateName(name string) error {
+	if name == "" {
+		return ErrNameEmpty
+	}
+
+	if name == "." || name == ".." {
+		return fmt.Errorf("%q: %w", name, ErrNameReserved)
+	}
+
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%q: %w", name, ErrNameEncoding)
+	}
+
+	for _, char := range name {
+		if char < 0x20 {
+			return fmt.Errorf("character %#02x: %w", char, ErrNameControlChar)
+		}
+
+		if strings.ContainsRune(illegalNameChars, char) {
+			return fmt.Errorf("character %q: %w", char, ErrNameIllegalChar)
+		}
+	}
+
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return ErrNameTrailingChar
+	}
+
+	if isReservedName(name) {
+		return fmt.Errorf("%q: %w", name, ErrNameReserved)
+	}
+
+	if len(utf16.Encode([]rune(name))) > MaxLongNameLength {
+		return ErrNameTooLong
+	}
+
+	return nil
+}
+
+// isReservedName returns true if the name is a DOS device name. The
+// extension is ignored, so "nul.txt" is reserved too.
+func isReservedName(name string) bool {
+	base, _, _ := strings.Cut(name, ".")
+	return reservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// foldName returns a key for the name that is the same for all names
+// strings.EqualFold considers equal, by mapping every character to the
+// smallest one it folds to under Unicode simple case folding.
+func foldName(name string) string {
+	return strings.Map(func(char rune) rune {
+		min := char
+		for f := unicode.SimpleFold(char); f != char; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+
+		return min
+	}, name)
+}
+
+// SanitizeName maps a file name to one that passes ValidateName:
+// illegal and control characters become underscores, trailing dots and
+// spaces are dropped, device names get an underscore appended and
+// overlong names are shortened, keeping the extension where possible.
+func SanitizeName(name string) string {
+	name = strings.ToValidUTF8(name, "_")
+
+	name = strings.Map(func(char rune) rune {
+		if char < 0x20 || strings.ContainsRune(illegalNameChars, char) {
+			return '_'
+		}
+
+		return char
+	}, name)
+
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+
+	base, ext := name, ""
+	if idx := strings.LastIndex(name, "."); idx > 0 {
+		base, ext = name[:idx], name[idx:]
+	}
+
+	if isReservedName(name) {
+		base = strings.TrimRight(base, " ") + "_"
+	}
+
+	// Shorten the base name a character at a time so that surrogate
+	// pairs are never split
+	units := utf16.Encode([]rune(base + ext))
+	for len(units) > MaxLongNameLength {
+		runes := []rune(base)
+		if len(runes) <= 1 {
+			// The extension alone is too long
+			base, ext = string(utf16.Decode(units[:MaxLongNameLength])), ""
+			break
+		}
+
+		base = string(runes[:len(runes)-1])
+		units = utf16.Encode([]rune(base + ext))
+	}
+
+	return strings.TrimRight(base+ext, ". ")
+}
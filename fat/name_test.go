@@ -0,0 +1,88 @@
+package fat
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	cases := map[string]error{
+		"hello.txt":              nil,
+		" leading space":         nil,
+		"console.txt":            nil,
+		"COM10":                  nil,
+		"":                       ErrNameEmpty,
+		".":                      ErrNameReserved,
+		"..":                     ErrNameReserved,
+		"a/b":                    ErrNameIllegalChar,
+		"a\\b":                   ErrNameIllegalChar,
+		"what?":                  ErrNameIllegalChar,
+		"a:b":                    ErrNameIllegalChar,
+		"tab\there":              ErrNameControlChar,
+		"trailing.":              ErrNameTrailingChar,
+		"trailing ":              ErrNameTrailingChar,
+		"CON":                    ErrNameReserved,
+		"nul.txt":                ErrNameReserved,
+		"Lpt1 .doc":              ErrNameReserved,
+		"bad\xffutf8":            ErrNameEncoding,
+		strings.Repeat("a", 256): ErrNameTooLong,
+	}
+
+	for name, expected := range cases {
+		err := ValidateName(name)
+		if expected == nil {
+			if err != nil {
+				t.Fatalf("%q: unexpected error: %s", name, err)
+			}
+			continue
+		}
+
+		if !errors.Is(err, expected) || !errors.Is(err, ErrInvalidName) || !errors.Is(err, fs.ErrInvalid) {
+			t.Fatalf("%q: expected %v, got %v", name, expected, err)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	cases := map[string]string{
+		"hello.txt":    "hello.txt",
+		"a:b?.txt":     "a_b_.txt",
+		"trailing. . ": "trailing",
+		"...":          "_",
+		"CON":          "CON_",
+		"nul.txt":      "nul_.txt",
+		"tab\there":    "tab_here",
+	}
+
+	for name, expected := range cases {
+		if actual := SanitizeName(name); actual != expected {
+			t.Fatalf("%q: expected %q, got %q", name, expected, actual)
+		}
+	}
+
+	long := SanitizeName(strings.Repeat("ж", 300) + ".txt")
+	if err := ValidateName(long); err != nil || !strings.HasSuffix(long, ".txt") {
+		t.Fatalf("bad long name %q: %v", long, err)
+	}
+}
+
+func TestDirectory_AddInvalidName(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	rootDir, err := fatFs.RootDir()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := rootDir.AddFile("aux.txt"); !errors.Is(err, ErrNameReserved) {
+		t.Fatalf("expected ErrNameReserved, got %v", err)
+	}
+	if err := fatFs.Mkdir("a*b"); !errors.Is(err, ErrNameIllegalChar) {
+		t.Fatalf("expected ErrNameIllegalChar, got %v", err)
+	}
+	if len(rootDir.Entries()) != 0 {
+		t.Fatal("no entry should have been created")
+	}
+}
@@ -0,0 +1,425 @@
+package fat
+
+import (
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rstms/ffs"
+)
+
+// splitPath splits a slash separated path into its components. Empty
+// and "." components are dropped and ".." removes the previous
+// component; it never climbs above the root.
+func splitPath(name string) []string {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) > 0 {
+				parts = parts[:len(parts)-1]
+			}
+		default:
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
+
+// root returns a Directory for the root directory.
+func (f *FileSystem) root() *Directory {
+	return &Directory{
+		device:     f.device,
+		dirCluster: f.rootDir,
+		fat:        f.fat,
+		fs:         f,
+	}
+}
+
+// walk returns the directory named by the given path components.
+func (f *FileSystem) walk(op, name string, parts []string) (*Directory, error) {
+	dir := f.root()
+	for _, part := range parts {
+		entry := dir.entry(part)
+		if entry == nil {
+			return nil, &PathError{Op: op, Path: name, Err: ErrNotExist}
+		}
+
+		if !entry.isDir() {
+			return nil, &PathError{Op: op, Path: name, Err: ErrNotDir}
+		}
+
+		var err error
+		dir, err = entry.openDir()
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+
+	return dir, nil
+}
+
+// resolve returns the parent directory of the named path and the base
+// name within it. The base name is empty for the root directory.
+func (f *FileSystem) resolve(op, name string) (*Directory, string, error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return f.root(), "", nil
+	}
+
+	parent, err := f.walk(op, name, parts[:len(parts)-1])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return parent, parts[len(parts)-1], nil
+}
+
+// lookup returns the entry for the named path. The entry is nil for
+// the root directory, which has none.
+func (f *FileSystem) lookup(op, name string) (*Directory, *DirectoryEntry, error) {
+	parent, base, err := f.resolve(op, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if base == "" {
+		return parent, nil, nil
+	}
+
+	entry := parent.entry(base)
+	if entry == nil {
+		return nil, nil, &PathError{Op: op, Path: name, Err: ErrNotExist}
+	}
+
+	return parent, entry, nil
+}
+
+// Open opens the named file for reading. Paths are slash separated and
+// relative to the root directory, names are matched case-insensitively.
+func (f *FileSystem) Open(name string) (ffs.File, error) {
+	file, err := f.OpenFile(name, os.O_RDONLY)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return file, nil
+}
+
+// Create creates or truncates the named file and opens it for reading
+// and writing.
+func (f *FileSystem) Create(name string) (ffs.File, error) {
+	file, err := f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return file, nil
+}
+
+// OpenFile opens the named file with the given os.O_* flags. O_CREATE,
+// O_EXCL, O_TRUNC and O_APPEND have their usual meaning.
+func (f *FileSystem) OpenFile(name string, flag int) (ffs.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if writing {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		if err := f.checkWritable("open", name); err != nil {
+			return nil, Fatal(err)
+		}
+	} else {
+		f.lock.RLock()
+		defer f.lock.RUnlock()
+	}
+
+	parent, base, err := f.resolve("open", name)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if base == "" {
+		return nil, Fatal(&PathError{Op: "open", Path: name, Err: ErrIsDir})
+	}
+
+	entry := parent.entry(base)
+	switch {
+	case entry == nil && flag&os.O_CREATE == 0:
+		return nil, Fatal(&PathError{Op: "open", Path: name, Err: ErrNotExist})
+	case entry == nil:
+		entry, err = parent.addEntry(base, ffs.DirectoryAttr(0))
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, Fatal(&PathError{Op: "open", Path: name, Err: ErrExist})
+	case writing && entry.entry.attr&ffs.AttrReadOnly != 0:
+		return nil, Fatal(&PathError{Op: "open", Path: name, Err: fs.ErrPermission})
+	}
+
+	file, err := entry.openFile(flag)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if err := file.truncate(); err != nil {
+			return nil, Fatal(err)
+		}
+	}
+
+	return file, nil
+}
+
+// Mkdir creates the named directory. Its parent must already exist.
+func (f *FileSystem) Mkdir(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("mkdir", name); err != nil {
+		return Fatal(err)
+	}
+
+	parent, base, err := f.resolve("mkdir", name)
+	if err != nil {
+		return Fatal(err)
+	}
+
+	if base == "" || parent.entry(base) != nil {
+		return Fatal(&PathError{Op: "mkdir", Path: name, Err: ErrExist})
+	}
+
+	if _, err := parent.addDirectory(base); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// MkdirAll creates the named directory along with any missing parents.
+// It does nothing if the directory already exists.
+func (f *FileSystem) MkdirAll(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, err := f.mkdirAll("mkdir", name, splitPath(name)); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// mkdirAll returns the directory named by the given path components,
+// creating the missing ones.
+func (f *FileSystem) mkdirAll(op, name string, parts []string) (*Directory, error) {
+	dir := f.root()
+	for _, part := range parts {
+		entry := dir.entry(part)
+		if entry == nil {
+			if err := f.checkWritable(op, name); err != nil {
+				return nil, Fatal(err)
+			}
+
+			var err error
+			entry, err = dir.addDirectory(part)
+			if err != nil {
+				return nil, Fatal(err)
+			}
+		}
+
+		if !entry.isDir() {
+			return nil, Fatal(&PathError{Op: op, Path: name, Err: ErrNotDir})
+		}
+
+		var err error
+		dir, err = entry.openDir()
+		if err != nil {
+			return nil, Fatal(err)
+		}
+	}
+
+	return dir, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file. Its Sys method
+// returns the ffs.DirectoryEntry, or nil for the root directory.
+func (f *FileSystem) Stat(name string) (fs.FileInfo, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	_, entry, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if entry == nil {
+		return &fileInfo{name: "/", mode: fs.ModeDir | 0755}, nil
+	}
+
+	return newFileInfo(entry), nil
+}
+
+// Lookup returns the directory entry for the named path.
+func (f *FileSystem) Lookup(name string) (ffs.DirectoryEntry, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	_, entry, err := f.lookup("lookup", name)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if entry == nil {
+		// The root directory has no entry of its own
+		return nil, Fatal(&PathError{Op: "lookup", Path: name, Err: fs.ErrInvalid})
+	}
+
+	return entry, nil
+}
+
+// ReadDir returns the entries of the named directory sorted by name,
+// without the "." and ".." entries and the volume label.
+func (f *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	dir, err := f.walk("readdir", name, splitPath(name))
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	var result []fs.DirEntry
+	for _, entry := range dir.entries() {
+		if entry.name == "." || entry.name == ".." || entry.entry.IsVolumeId() {
+			continue
+		}
+
+		result = append(result, fs.FileInfoToDirEntry(newFileInfo(entry)))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+
+	return result, nil
+}
+
+// Remove removes the named file or empty directory. Its directory
+// entries are marked deleted and its clusters are freed.
+func (f *FileSystem) Remove(name string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("remove", name); err != nil {
+		return Fatal(err)
+	}
+
+	parent, entry, err := f.lookup("remove", name)
+	if err != nil {
+		return Fatal(err)
+	}
+
+	if entry == nil {
+		return Fatal(&PathError{Op: "remove", Path: name, Err: fs.ErrInvalid})
+	}
+
+	if entry.isDir() {
+		dir, err := entry.openDir()
+		if err != nil {
+			return Fatal(err)
+		}
+
+		for _, child := range dir.entries() {
+			if child.name != "." && child.name != ".." {
+				return Fatal(&PathError{Op: "remove", Path: name, Err: ErrNotEmpty})
+			}
+		}
+	}
+
+	if err := f.removeEntry(parent, entry); err != nil {
+		return Fatal(err)
+	}
+
+	if entry.isDir() {
+		f.dirsLock.Lock()
+		delete(f.dirs, entry.entry.cluster)
+		f.dirsLock.Unlock()
+	}
+
+	return nil
+}
+
+// removeEntry marks the directory entries of entry deleted, frees its
+// clusters and writes the FAT and the parent directory.
+func (f *FileSystem) removeEntry(parent *Directory, entry *DirectoryEntry) error {
+	for _, lfn := range entry.lfnEntries {
+		lfn.deleted = true
+	}
+	entry.entry.deleted = true
+	if index := parent.dirCluster.index; index != nil {
+		index.remove(entry.name, entry.entry.shortName())
+	}
+
+	if entry.entry.cluster != 0 {
+		if err := f.fat.FreeChain(entry.entry.cluster); err != nil {
+			return Fatal(err)
+		}
+
+		if err := f.fat.WriteToDevice(f.device); err != nil {
+			return Fatal(err)
+		}
+	}
+
+	if err := parent.dirCluster.WriteToDevice(f.device, f.fat); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// fileInfo implements fs.FileInfo for a directory entry.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	entry   *DirectoryEntry
+}
+
+func newFileInfo(entry *DirectoryEntry) *fileInfo {
+	mode := fs.FileMode(0644)
+	if entry.isDir() {
+		mode = fs.ModeDir | 0755
+	}
+
+	if entry.entry.attr&ffs.AttrReadOnly != 0 {
+		mode &^= 0222
+	}
+
+	return &fileInfo{
+		name:    entry.name,
+		size:    int64(entry.entry.fileSize),
+		mode:    mode,
+		modTime: entry.entry.writeTime,
+		entry:   entry,
+	}
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) IsDir() bool        { return i.mode.IsDir() }
+
+func (i *fileInfo) Sys() any {
+	// Avoid returning a typed nil for the root directory
+	if i.entry == nil {
+		return nil
+	}
+
+	return i.entry
+}
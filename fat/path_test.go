@@ -0,0 +1,205 @@
+package fat
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	cases := map[string][]string{
+		"":               nil,
+		"/":              nil,
+		"//a///b/":       {"a", "b"},
+		"./a/./b":        {"a", "b"},
+		"a/b/../c":       {"a", "c"},
+		"/../../a":       {"a"},
+		"a/long name.tx": {"a", "long name.tx"},
+	}
+
+	for input, expected := range cases {
+		if actual := splitPath(input); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("%q: expected %v, got %v", input, expected, actual)
+		}
+	}
+}
+
+func TestFileSystem_Paths(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	if err := fatFs.MkdirAll("/Docs/Notes/"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// MkdirAll is a no-op for existing directories
+	if err := fatFs.MkdirAll("docs//notes"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err := fatFs.Create("/docs/./notes/../Notes/Read me.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := io.WriteString(file, "hello"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Append, then read back through a fresh filesystem
+	file, err = fatFs.OpenFile("DOCS/NOTES/READ ME.TXT", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := io.WriteString(file, " world"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file, err = fatFs.Open("docs/notes/read me.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != "hello world" {
+		t.Fatalf("bad content: %q", data)
+	}
+	if _, err := file.Write([]byte("x")); !errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("writing a read-only handle should fail, got %v", err)
+	}
+
+	info, err := fatFs.Stat("/docs/notes/read me.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.Name() != "Read me.txt" || info.Size() != 11 || info.IsDir() {
+		t.Fatalf("bad info: %s %d %v", info.Name(), info.Size(), info.IsDir())
+	}
+
+	info, err = fatFs.Stat("/")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !info.IsDir() {
+		t.Fatal("root should be a directory")
+	}
+
+	entries, err := fatFs.ReadDir("/docs/notes")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "Read me.txt" {
+		t.Fatalf("bad entries: %v", entries)
+	}
+
+	// Truncate on create
+	file, err = fatFs.Create("docs/notes/read me.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info, _ := fatFs.Stat("docs/notes/read me.txt"); info.Size() != 0 {
+		t.Fatalf("file should be truncated, size %d", info.Size())
+	}
+	file.Close()
+}
+
+func TestFileSystem_PathErrors(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	if _, err := fatFs.Create("a.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := fatFs.Mkdir("dir"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := fatFs.Open("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if _, err := fatFs.Open("a.txt/b"); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("expected ErrNotDir, got %v", err)
+	}
+	if _, err := fatFs.Open("dir"); !errors.Is(err, ErrIsDir) {
+		t.Fatalf("expected ErrIsDir, got %v", err)
+	}
+	if _, err := fatFs.OpenFile("A.TXT", os.O_RDWR|os.O_CREATE|os.O_EXCL); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+	if err := fatFs.Mkdir("DIR"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+	if err := fatFs.Mkdir("x/y"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if err := fatFs.MkdirAll("a.txt/y"); !errors.Is(err, ErrNotDir) {
+		t.Fatalf("expected ErrNotDir, got %v", err)
+	}
+
+	var pathErr *PathError
+	if _, err := fatFs.Stat("dir/missing"); !errors.As(err, &pathErr) || pathErr.Path != "dir/missing" {
+		t.Fatalf("expected a PathError, got %v", err)
+	}
+}
+
+func TestFileSystem_Remove(t *testing.T) {
+	device, fatFs := newTestFloppy(t)
+
+	free := func() int {
+		count := 0
+		for _, entry := range fatFs.fat.entries[2:] {
+			if entry == 0 {
+				count++
+			}
+		}
+		return count
+	}
+	before := free()
+
+	if err := fatFs.MkdirAll("dir/sub"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	file, err := fatFs.Create("dir/a long file name.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := file.Write(make([]byte, 5000)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := fatFs.Remove("dir"); !errors.Is(err, ErrNotEmpty) {
+		t.Fatalf("expected ErrNotEmpty, got %v", err)
+	}
+
+	for _, name := range []string{"dir/A Long File Name.txt", "dir/sub", "dir"} {
+		if err := fatFs.Remove(name); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if after := free(); after != before {
+		t.Fatalf("expected %d free clusters, got %d", before, after)
+	}
+
+	// The deletion must be on the device and the slots reusable
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := fatFs.Stat("dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	entries := len(fatFs.rootDir.entries)
+	if err := fatFs.Mkdir("new"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(fatFs.rootDir.entries) != entries {
+		t.Fatal("deleted slot should have been reused")
+	}
+}
@@ -0,0 +1,265 @@
+package fat
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/rstms/ffs"
+)
+
+// PinAttr are the attributes of a pinned file. Boot loaders such as
+// syslinux patch the sectors of their second stage into the boot
+// sector, so the file must be contiguous and never be moved. Files with
+// all of these attributes and contiguous clusters are treated as pinned.
+const PinAttr = ffs.AttrSystem | ffs.AttrHidden | ffs.AttrReadOnly
+
+// FileSectors returns the sectors holding the named file up to its
+// size. The sectors are relative to the start of the volume; add the
+// hidden sectors of the boot sector for a volume on a partition.
+func (f *FileSystem) FileSectors(name string) ([]uint32, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	_, entry, err := f.lookup("sectors", name)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if entry == nil || entry.isDir() {
+		return nil, Fatal(&PathError{Op: "sectors", Path: name, Err: ErrIsDir})
+	}
+
+	sectors, err := f.fileSectors(entry)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return sectors, nil
+}
+
+func (f *FileSystem) fileSectors(entry *DirectoryEntry) ([]uint32, error) {
+	chain, err := f.fat.Chain(entry.entry.cluster)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	bps := uint32(f.bs.BytesPerSector)
+	count := int((entry.entry.fileSize + bps - 1) / bps)
+
+	sectors := make([]uint32, 0, count)
+	for _, cluster := range chain {
+		first := f.bs.ClusterOffset(int(cluster)) / bps
+		for i := uint32(0); i < uint32(f.bs.SectorsPerCluster) && len(sectors) < count; i++ {
+			sectors = append(sectors, first+i)
+		}
+	}
+
+	if len(sectors) < count {
+		return nil, Fatalf("%s: chain too short for %d bytes: %w", entry.name, entry.entry.fileSize, ErrCorrupt)
+	}
+
+	return sectors, nil
+}
+
+// PinFile makes the named file contiguous, moving it if it isn't, and
+// sets PinAttr. It returns the sectors of the file like FileSectors.
+func (f *FileSystem) PinFile(name string) ([]uint32, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("pin", name); err != nil {
+		return nil, Fatal(err)
+	}
+
+	_, entry, err := f.lookup("pin", name)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if entry == nil || entry.isDir() {
+		return nil, Fatal(&PathError{Op: "pin", Path: name, Err: ErrIsDir})
+	}
+
+	if err := f.makeContiguous(entry); err != nil {
+		return nil, Fatal(err)
+	}
+
+	entry.entry.attr |= PinAttr
+	if err := entry.dir.dirCluster.WriteToDevice(f.device, f.fat); err != nil {
+		return nil, Fatal(err)
+	}
+
+	sectors, err := f.fileSectors(entry)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return sectors, nil
+}
+
+// makeContiguous moves the clusters of the file to a contiguous run if
+// they aren't one already.
+func (f *FileSystem) makeContiguous(entry *DirectoryEntry) error {
+	chain, err := f.fat.Chain(entry.entry.cluster)
+	if err != nil {
+		return Fatal(err)
+	}
+
+	if len(chain) > 0 && Contiguous(chain) {
+		return nil
+	}
+
+	start, err := f.fat.AllocContiguous(max(len(chain), 1))
+	if err != nil {
+		return Fatal(err)
+	}
+
+	data := make([]byte, f.bs.BytesPerCluster())
+	for i, cluster := range chain {
+		if _, err := f.device.ReadAt(data, int64(f.bs.ClusterOffset(int(cluster)))); err != nil {
+			return Fatal(err)
+		}
+
+		if _, err := f.device.WriteAt(data, int64(f.bs.ClusterOffset(int(start)+i))); err != nil {
+			return Fatal(err)
+		}
+	}
+
+	if entry.entry.cluster != 0 {
+		if err := f.fat.FreeChain(entry.entry.cluster); err != nil {
+			return Fatal(err)
+		}
+	}
+
+	if err := f.fat.WriteToDevice(f.device); err != nil {
+		return Fatal(err)
+	}
+
+	entry.entry.cluster = start
+	if err := entry.dir.dirCluster.WriteToDevice(f.device, f.fat); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// PinFileAt creates the named file with the given data at the given
+// sector, relative to the start of the volume, and sets PinAttr.
+// Missing parent directories are created. It is used to recreate a
+// pinned file at the sectors a boot sector refers to, so it fails if the
+// sector doesn't start a cluster or the clusters are in use.
+func (f *FileSystem) PinFileAt(name string, sector uint32, data []byte) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.checkWritable("pin", name); err != nil {
+		return Fatal(err)
+	}
+
+	bps := uint32(f.bs.BytesPerSector)
+	spc := uint32(f.bs.SectorsPerCluster)
+	dataStart := f.bs.DataOffset() / bps
+	if sector < dataStart || (sector-dataStart)%spc != 0 {
+		err := fmt.Errorf("sector %d doesn't start a cluster: %w", sector, fs.ErrInvalid)
+		return Fatal(&PathError{Op: "pin", Path: name, Err: err})
+	}
+
+	start := (sector-dataStart)/spc + FirstCluster
+	bpc := int(f.bs.BytesPerCluster())
+	count := max((len(data)+bpc-1)/bpc, 1)
+
+	// Claim the clusters before anything else is allocated
+	if err := f.fat.allocRun(start, count); err != nil {
+		return Fatal(&PathError{Op: "pin", Path: name, Err: err})
+	}
+
+	if err := f.pinFileAt(name, start, data); err != nil {
+		// Give the clusters back, pinFileAt took its entry out again
+		if freeErr := f.fat.FreeChain(start); freeErr != nil {
+			return Fatal(errors.Join(err, freeErr))
+		}
+
+		if writeErr := f.fat.WriteToDevice(f.device); writeErr != nil {
+			return Fatal(errors.Join(err, writeErr))
+		}
+
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+func (f *FileSystem) pinFileAt(name string, start uint32, data []byte) error {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return Fatal(&PathError{Op: "pin", Path: name, Err: ErrIsDir})
+	}
+
+	parent, err := f.mkdirAll("pin", name, parts[:len(parts)-1])
+	if err != nil {
+		return Fatal(err)
+	}
+
+	base := parts[len(parts)-1]
+	if parent.entry(base) != nil {
+		return Fatal(&PathError{Op: "pin", Path: name, Err: ErrExist})
+	}
+
+	entry, err := parent.addEntry(base, PinAttr)
+	if err != nil {
+		return Fatal(err)
+	}
+
+	if err := f.placePinned(parent, entry, start, data); err != nil {
+		// The caller frees the pinned clusters, so only the cluster the
+		// entry was created with is freed with it
+		if entry.entry.cluster == start {
+			entry.entry.cluster = 0
+		}
+
+		if removeErr := f.removeEntry(parent, entry); removeErr != nil {
+			return Fatal(errors.Join(err, removeErr))
+		}
+
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// placePinned swaps the cluster the new entry was created with for the
+// pinned ones starting at start and writes the data there.
+func (f *FileSystem) placePinned(parent *Directory, entry *DirectoryEntry, start uint32, data []byte) error {
+	if err := f.fat.FreeChain(entry.entry.cluster); err != nil {
+		return Fatal(err)
+	}
+	entry.entry.cluster = start
+
+	if _, err := f.device.WriteAt(data, int64(f.bs.ClusterOffset(int(start)))); err != nil {
+		return Fatal(err)
+	}
+
+	if err := f.fat.WriteToDevice(f.device); err != nil {
+		return Fatal(err)
+	}
+
+	entry.entry.fileSize = uint32(len(data))
+	if err := parent.dirCluster.WriteToDevice(f.device, f.fat); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// Contiguous returns true if every cluster or sector of the list
+// follows the one before it, as for the sectors of a pinned file.
+func Contiguous(list []uint32) bool {
+	for i := 1; i < len(list); i++ {
+		if list[i] != list[i-1]+1 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,179 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFileSystem_PinFile(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	// Interleave the clusters of two files so that a.sys is fragmented
+	a, err := fatFs.Create("a.sys")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	b, err := fatFs.Create("b.txt")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	for i := 0; i < 4; i++ {
+		if _, err := a.Write(content[i*400 : (i+1)*400]); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if _, err := b.Write(make([]byte, 512)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	sectors, err := fatFs.FileSectors("a.sys")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(sectors) != 4 || sectors[1] == sectors[0]+1 {
+		t.Fatalf("expected a fragmented file, got %v", sectors)
+	}
+
+	sectors, err = fatFs.PinFile("a.sys")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i := range sectors {
+		if sectors[i] != sectors[0]+uint32(i) {
+			t.Fatalf("not contiguous: %v", sectors)
+		}
+	}
+
+	entry, err := fatFs.Lookup("a.sys")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if entry.Attr()&PinAttr != PinAttr {
+		t.Fatalf("bad attributes %#02x", entry.Attr())
+	}
+
+	file, err := fatFs.Open("a.sys")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Fatal("content changed")
+	}
+
+	// Already contiguous, so it stays where it is
+	again, err := fatFs.PinFile("a.sys")
+	if err != nil || again[0] != sectors[0] {
+		t.Fatalf("pinned file moved to %v: %v", again, err)
+	}
+
+	if _, err := fatFs.PinFile("/"); !errors.Is(err, ErrIsDir) {
+		t.Fatalf("expected ErrIsDir, got %v", err)
+	}
+}
+
+func TestFileSystem_PinFileAt(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	dataStart := fatFs.bs.DataOffset() / uint32(fatFs.bs.BytesPerSector)
+	sector := dataStart + 100
+	content := bytes.Repeat([]byte("ldlinux"), 200)
+	if err := fatFs.PinFileAt("boot/syslinux/ldlinux.sys", sector, content); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	sectors, err := fatFs.FileSectors("boot/syslinux/ldlinux.sys")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(sectors) != 3 || sectors[0] != sector || sectors[2] != sector+2 {
+		t.Fatalf("bad sectors %v", sectors)
+	}
+
+	file, err := fatFs.Open("boot/syslinux/ldlinux.sys")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("bad content: %v", err)
+	}
+
+	if err := fatFs.PinFileAt("other.sys", sector+1, content); !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("expected ErrNoSpace, got %v", err)
+	}
+	if err := fatFs.PinFileAt("other.sys", dataStart-1, content); err == nil {
+		t.Fatal("expected error for a sector before the data region")
+	}
+
+	// The failed attempts left no clusters allocated
+	if _, err := fatFs.Create("other.sys"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := fatFs.PinFileAt("other.sys", dataStart+200, content); !errors.Is(err, ErrExist) {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+	if err := fatFs.PinFileAt("new.sys", dataStart+200, content); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestFileSystem_PinFileAtWriteError(t *testing.T) {
+	device, _ := newTestFloppy(t)
+
+	// Data starts at sector 33 of a 1.44M floppy
+	sector := uint32(33 + 100)
+	faulty := &faultyDevice{
+		BlockDevice: device,
+		badWrites:   []BadBlock{{int64(sector) * 512, 512}},
+	}
+	fatFs, err := New(faulty)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	free := func(fatFs *FileSystem) int {
+		allocation, err := fatFs.AllocationMap()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		count := 0
+		for _, info := range allocation.Clusters {
+			if info.State == ClusterFree {
+				count++
+			}
+		}
+
+		return count
+	}
+	before := free(fatFs)
+
+	content := bytes.Repeat([]byte("ldlinux"), 200)
+	if err := fatFs.PinFileAt("ldlinux.sys", sector, content); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("expected io.ErrShortWrite, got %v", err)
+	}
+
+	// Neither the entry nor any cluster is left behind, on the device
+	// either
+	fatFs, err = New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := fatFs.Lookup("ldlinux.sys"); err == nil {
+		t.Fatal("entry of the failed file left behind")
+	}
+	if after := free(fatFs); after != before {
+		t.Fatalf("%d free clusters, expected %d", after, before)
+	}
+
+	if err := fatFs.PinFileAt("ldlinux.sys", sector, content); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
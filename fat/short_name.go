@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // checksumShortName returns the checksum for the shortname that is used
@@ -17,77 +19,167 @@ func checksumShortName(name string) uint8 {
 	return sum
 }
 
+// The number of numeric tails Windows tries before it switches to the
+// hashed form of a short name.
+const maxPlainNumericTail = 4
+
+// shortNameIndex is the set of short names in use in a directory, in
+// OEM bytes.
+type shortNameIndex map[string]bool
+
 // generateShortName takes a list of existing short names and a long
-// name and generates the next valid short name. This process is done
-// according to the MS specification.
+// name and generates the next valid short name in CP437.
 func generateShortName(longName string, used []string) (string, error) {
-	longName = strings.ToUpper(longName)
+	return generateShortNameCodePage(longName, used, CP437)
+}
+
+// generateShortNameCodePage is generateShortName for the given code
+// page. Both the used names and the result are OEM bytes in it.
+func generateShortNameCodePage(longName string, used []string, codePage CodePage) (string, error) {
+	index := make(shortNameIndex, len(used))
+	for _, name := range used {
+		index[upperOEM(name)] = true
+	}
+
+	return index.generate(longName, codePage)
+}
+
+// generate returns the next unused short name for a long name the way
+// Windows does: the basis name, without leading dots, is used as is if
+// it is lossless and free, otherwise the first six characters get a
+// "~1" to "~4" tail and after that the first two characters are
+// followed by four hex digits of a hash of the long name and a tail.
+func (index shortNameIndex) generate(longName string, codePage CodePage) (string, error) {
+	upperName := strings.ToUpper(longName)
+
+	// Leading dots are dropped, so ".bashrc" has no extension
+	trimmed := strings.TrimLeft(upperName, ".")
+	leadingDots := trimmed != upperName
+	upperName = trimmed
 
 	// Split the string at the final "."
-	dotIdx := strings.LastIndex(longName, ".")
+	dotIdx := strings.LastIndex(upperName, ".")
 
 	var ext string
 	if dotIdx == -1 {
-		dotIdx = len(longName)
+		dotIdx = len(upperName)
 	} else {
-		ext = longName[dotIdx+1:]
+		ext = upperName[dotIdx+1:]
 	}
 
-	ext = cleanShortString(ext)
-	ext = ext[0:]
-	rawName := longName[0:dotIdx]
-	name := cleanShortString(rawName)
-	simpleName := fmt.Sprintf("%s.%s", name, ext)
-	if ext == "" {
-		simpleName = simpleName[0 : len(simpleName)-1]
+	ext, _ = cleanShortString(ext, codePage)
+	name, lossy := cleanShortString(upperName[0:dotIdx], codePage)
+	lossy = lossy || leadingDots || name == ""
+
+	if !lossy && len(name) <= 8 && len(ext) <= 3 {
+		if simpleName := joinShortName(name, ext); !index[simpleName] {
+			return simpleName, nil
+		}
+	}
+
+	if len(ext) > 3 {
+		ext = ext[:3]
 	}
 
-	doSuffix := name != rawName || len(name) > 8 || len(ext) > 3
-	if !doSuffix {
-		for _, usedSingle := range used {
-			if strings.ToUpper(usedSingle) == simpleName {
-				doSuffix = true
-				break
+	hash := fmt.Sprintf("%04X", shortNameHash(longName))
+	for i := 1; i < 1000000; i++ {
+		prefix := name
+		serial := fmt.Sprintf("~%d", i)
+		if i > maxPlainNumericTail {
+			if len(prefix) > 2 {
+				prefix = prefix[:2]
 			}
+
+			prefix += hash
+			serial = fmt.Sprintf("~%d", i-maxPlainNumericTail)
 		}
-	}
 
-	if doSuffix {
-		if len(ext) > 3 {
-			ext = ext[:3]
+		if len(prefix) > 8-len(serial) {
+			prefix = prefix[:8-len(serial)]
 		}
-		found := false
-		for i := 1; i < 99999; i++ {
-			serial := fmt.Sprintf("~%d", i)
 
-			nameOffset := 8 - len(serial)
-			if len(name) < nameOffset {
-				nameOffset = len(name)
-			}
+		if simpleName := joinShortName(prefix+serial, ext); !index[simpleName] {
+			return simpleName, nil
+		}
+	}
 
-			serialName := fmt.Sprintf("%s%s", name[0:nameOffset], serial)
-			simpleName = fmt.Sprintf("%s.%s", serialName, ext)
+	return "", Fatalf("could not generate short name for %s", longName)
+}
 
-			exists := false
-			for _, usedSingle := range used {
-				if strings.ToUpper(usedSingle) == simpleName {
-					exists = true
-					break
-				}
-			}
+// joinShortName returns "NAME.EXT", or "NAME" if there's no extension.
+func joinShortName(name, ext string) string {
+	if ext == "" {
+		return name
+	}
 
-			if !exists {
-				found = true
-				break
-			}
+	return name + "." + ext
+}
+
+// shortNameHash returns the 16 bit hash of the long name used for the
+// hex digits of hashed short names. It is modelled on the undocumented
+// checksum of Windows NT as it has been reverse engineered.
+func shortNameHash(longName string) uint16 {
+	var checksum uint16
+	for _, unit := range utf16.Encode([]rune(longName)) {
+		checksum = checksum*0x25 + unit
+	}
+
+	temp := int32(checksum) * 314159269
+	if temp < 0 {
+		temp = -temp
+	}
+
+	temp -= int32((uint64(temp)*1152921497)>>60) * 1000000007
+	checksum = uint16(temp)
+
+	// The nibbles come out in reverse order
+	return checksum>>12 | (checksum>>4)&0x00F0 | (checksum<<4)&0x0F00 | checksum<<12
+}
+
+// upperOEM upper-cases the ASCII letters of OEM bytes. Other bytes are
+// left alone since they can't be interpreted without the code page.
+func upperOEM(name string) string {
+	result := []byte(name)
+	for i, b := range result {
+		if b >= 'a' && b <= 'z' {
+			result[i] = b - 'a' + 'A'
 		}
+	}
+
+	return string(result)
+}
 
-		if !found {
-			return "", Fatalf("could not generate short name for %s", longName)
+// shortNameCase returns the NT case flags that turn the short name into
+// the given name. It returns false if the name can't be shown that way,
+// because it differs by more than case or mixes cases within the base
+// name or the extension. A name with an empty base, such as ".ab", is
+// never shown that way, since a short entry with a blank base is
+// invalid.
+func shortNameCase(name, shortName string) (uint8, bool) {
+	base, ext, _ := strings.Cut(name, ".")
+	shortBase, shortExt, _ := strings.Cut(shortName, ".")
+	if base == "" || shortBase == "" {
+		return 0, false
+	}
+
+	var flags uint8
+	for _, part := range []struct {
+		value, short string
+		flag         uint8
+	}{
+		{base, shortBase, NTLowerBase},
+		{ext, shortExt, NTLowerExt},
+	} {
+		switch {
+		case part.value == part.short:
+		case part.value == strings.ToLower(part.short) && strings.ToUpper(part.value) == part.short:
+			flags |= part.flag
+		default:
+			return 0, false
 		}
 	}
 
-	return simpleName, nil
+	return flags, true
 }
 
 // shortNameEntryValue returns the proper formatted short name value
@@ -127,22 +219,35 @@ func shortNameEntryValue(name string) string {
 	return fmt.Sprintf("%s%s", shortParts[0], shortParts[1])
 }
 
-func cleanShortString(v string) string {
+// cleanShortString converts v to OEM bytes that are valid in a short
+// name. It also returns true if characters had to be dropped or
+// replaced.
+func cleanShortString(v string, codePage CodePage) (string, bool) {
 	var result bytes.Buffer
+	lossy := false
 	for _, char := range v {
 		// We skip these chars
 		if char == '.' || char == ' ' {
+			lossy = true
 			continue
 		}
 
+		if char >= utf8.RuneSelf {
+			if b, ok := codePage.encodeRune(char); ok {
+				result.WriteByte(b)
+				continue
+			}
+		}
+
 		if !validShortChar(char) {
 			char = '_'
+			lossy = true
 		}
 
-		result.WriteRune(char)
+		result.WriteByte(byte(char))
 	}
 
-	return result.String()
+	return result.String(), lossy
 }
 
 func validShortChar(char rune) bool {
@@ -1,6 +1,9 @@
 package fat
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestGenerateShortName(t *testing.T) {
 	// Test a basic one with no used
@@ -53,14 +56,21 @@ func TestGenerateShortName(t *testing.T) {
 		t.Fatalf("unexpected: %s", result)
 	}
 
-	// Test dotfile
-	result, err = generateShortName(".big", []string{})
-	if err != nil {
-		t.Fatalf("err should be nil: %s", err)
-	}
+	// Test dotfiles: the leading dot is dropped, so there is no
+	// extension, and the basis is lossy
+	for name, expected := range map[string]string{
+		".big":    "BIG~1",
+		".ab":     "AB~1",
+		".bashrc": "BASHRC~1",
+	} {
+		result, err = generateShortName(name, []string{})
+		if err != nil {
+			t.Fatalf("err should be nil: %s", err)
+		}
 
-	if result != ".BIG" {
-		t.Fatalf("unexpected: %s", result)
+		if result != expected {
+			t.Fatalf("%s: unexpected: %s", name, result)
+		}
 	}
 
 	// Test valid extension
@@ -119,14 +129,14 @@ func TestShortNameEntryValue(t *testing.T) {
 		t.Fatalf("expected %s, got %s", expected, entryValue)
 	}
 
-	// Test dotfile entry
+	// Test dotfile entry, which never has a blank base
 	shortName, err := generateShortName(".big", []string{})
 	if err != nil {
 		t.Fatalf("err should be nil: %s", err)
 	}
 
 	entryValue = shortNameEntryValue(shortName)
-	expected = "        BIG"
+	expected = "BIG~1      "
 	if entryValue != expected {
 		t.Fatalf("expected %s, got %s", expected, entryValue)
 	}
@@ -167,3 +177,96 @@ func TestShortNameEntryValue(t *testing.T) {
 		t.Fatalf("expected %s, got %s", expected, entryValue)
 	}
 }
+
+func TestGenerateShortName_Hashed(t *testing.T) {
+	used := []string{"LONGFI~1.TXT", "LONGFI~2.TXT", "LONGFI~3.TXT", "LONGFI~4.TXT"}
+	result, err := generateShortName("long file name.txt", used)
+	if err != nil {
+		t.Fatalf("err should be nil: %s", err)
+	}
+
+	expected := fmt.Sprintf("LO%04X~1.TXT", shortNameHash("long file name.txt"))
+	if result != expected {
+		t.Fatalf("expected %s, got %s", expected, result)
+	}
+
+	result, err = generateShortName("long file name.txt", append(used, expected))
+	if err != nil {
+		t.Fatalf("err should be nil: %s", err)
+	}
+
+	if result != expected[:6]+"~2.TXT" {
+		t.Fatalf("unexpected: %s", result)
+	}
+
+	// No trailing dot without an extension
+	result, err = generateShortName("foobarbazblah", []string{})
+	if err != nil {
+		t.Fatalf("err should be nil: %s", err)
+	}
+
+	if result != "FOOBAR~1" {
+		t.Fatalf("unexpected: %s", result)
+	}
+}
+
+func TestDirectory_ManyShortNames(t *testing.T) {
+	_, fatFs := newTestFloppy(t)
+
+	if err := fatFs.Mkdir("many"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	shortNames := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		if _, err := fatFs.Create(fmt.Sprintf("many/common prefix %d.txt", i)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	entries, err := fatFs.ReadDir("many")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		shortName := info.Sys().(*DirectoryEntry).ShortName()
+		if shortNames[shortName] {
+			t.Fatalf("duplicate short name %s", shortName)
+		}
+		shortNames[shortName] = true
+	}
+
+	if len(shortNames) != 300 || !shortNames["COMMON~4.TXT"] || shortNames["COMMON~5.TXT"] {
+		t.Fatalf("unexpected short names: %d", len(shortNames))
+	}
+}
+
+func TestGenerateShortNameCodePage(t *testing.T) {
+	result, err := generateShortNameCodePage("Ж.txt", []string{}, CP866)
+	if err != nil {
+		t.Fatalf("err should be nil: %s", err)
+	}
+
+	expected, err := CP866.Encode("Ж.TXT")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != expected {
+		t.Fatalf("expected %q, got %q", expected, result)
+	}
+
+	// CP437 has no Cyrillic, so the name is lossy there
+	result, err = generateShortName("Ж.txt", []string{})
+	if err != nil {
+		t.Fatalf("err should be nil: %s", err)
+	}
+	if result != "_~1.TXT" {
+		t.Fatalf("unexpected: %s", result)
+	}
+}
@@ -1,6 +1,9 @@
 package fat
 
 import (
+	"errors"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/rstms/ffs"
@@ -18,6 +21,62 @@ type SuperFloppyConfig struct {
 
 	// The OEM name for the FAT filesystem. Defaults to "gofs" if not set.
 	OEMName string
+
+	// The OEM code page the label is encoded in. Defaults to CP437.
+	CodePage CodePage
+
+	// The name of a standard floppy format, see FloppyFormats. The
+	// device must have the size of the format. If not set, a FAT12
+	// device of a standard floppy size gets that format.
+	Floppy string
+
+	// The fields below override the values that are otherwise computed
+	// from the device size or taken from the floppy format. Zero means
+	// not set. The resulting layout must have a cluster count within the
+	// limits of FATType.
+
+	// Sectors per cluster, a power of two no larger than 32K in bytes.
+	SectorsPerCluster uint8
+
+	// Sectors in front of the first FAT, including the boot sector.
+	ReservedSectors uint16
+
+	// Number of FATs. Defaults to 2.
+	NumFATs uint8
+
+	// Number of entries in the FAT12/16 root directory. It must fill
+	// whole sectors. FAT32 has no fixed root directory.
+	RootEntryCount uint16
+
+	// The media descriptor byte, 0xF0 or 0xF8 to 0xFF.
+	Media MediaType
+
+	// The geometry reported to the BIOS.
+	SectorsPerTrack uint16
+	NumHeads        uint16
+
+	// The number of sectors in front of the volume, for a volume that is
+	// the partition of a larger disk.
+	HiddenSectors uint32
+
+	// The alignment in bytes of the FATs and the data region relative to
+	// the start of the disk, e.g. 4MiB for SD cards. The reserved sectors
+	// are padded and the FATs enlarged to reach it. Not aligned if 0.
+	Alignment uint32
+
+	// The boot code to install in the boot sector. If not set, the boot
+	// code area is left empty.
+	BootCode *BootCode
+
+	// ScanSurface reads the whole volume while formatting and marks the
+	// clusters that can't be read as bad. Unreadable sectors in front of
+	// the data region fail the format with ErrBadSystemArea.
+	ScanSurface bool
+
+	// BadBlocks are marked bad while formatting, e.g. the output of
+	// badblocks(8) read with ReadBadBlocks. Blocks in front of the data
+	// region fail the format with ErrBadSystemArea.
+	BadBlocks []BadBlock
 }
 
 // Formats an ffs.BlockDevice with the "super floppy" format according
@@ -38,29 +97,30 @@ func FormatSuperFloppy(device ffs.BlockDevice, config *SuperFloppyConfig) error
 type superFloppyFormatter struct {
 	config *SuperFloppyConfig
 	device ffs.BlockDevice
+	floppy *FloppyFormat
 }
 
 func (f *superFloppyFormatter) format() error {
-	// First, create the boot sector on the device. Start by configuring
-	// the common elements of the boot sector.
-	sectorsPerCluster, err := f.SectorsPerCluster()
+	// First, work out the layout of the filesystem
+	bsCommon, err := f.layout()
 	if err != nil {
 		return Fatal(err)
 	}
 
-	bsCommon := BootSectorCommon{
-		BytesPerSector:      uint16(f.device.SectorSize()),
-		Media:               MediaFixed,
-		NumFATs:             2,
-		NumHeads:            16,
-		OEMName:             f.config.OEMName,
-		ReservedSectorCount: f.ReservedSectorCount(),
-		SectorsPerCluster:   sectorsPerCluster,
-		SectorsPerTrack:     32,
-		TotalSectors:        uint32(f.device.Len() / int64(f.device.SectorSize())),
+	volumeLabel, err := f.VolumeLabel()
+	if err != nil {
+		return Fatal(err)
 	}
 
-	// Next, fill in the FAT-type specific boot sector information
+	// Bad blocks in front of the data region fail the format before
+	// anything is written
+	bad, err := f.badClusters(bsCommon)
+	if err != nil {
+		return Fatal(err)
+	}
+
+	// Next, create the boot sector on the device with the FAT-type
+	// specific information
 	switch f.config.FATType {
 	case FAT12, FAT16:
 		// Determine the filesystem type label, standard from the spec sheet
@@ -71,29 +131,11 @@ func (f *superFloppyFormatter) format() error {
 			label = "FAT16   "
 		}
 
-		// For 1.44MB Floppy, for other floppy formats see https://support.microsoft.com/en-us/kb/75131.
-		// We make an exception for this most common usecase as the calculations don't create a working image for older operating systems
-		if f.config.FATType == FAT12 && f.device.Len() == 1474560 {
-			bsCommon.RootEntryCount = 224
-			bsCommon.SectorsPerFat = 9
-			bsCommon.SectorsPerTrack = 18
-			bsCommon.Media = 240
-			bsCommon.NumHeads = 2
-		} else {
-			// Determine the number of root directory entries
-			if f.device.Len() > 512*5*32 {
-				bsCommon.RootEntryCount = 512
-			} else {
-				bsCommon.RootEntryCount = uint16(f.device.Len() / (5 * 32))
-			}
-
-			bsCommon.SectorsPerFat = f.sectorsPerFat(bsCommon.RootEntryCount, sectorsPerCluster)
-		}
-
 		bs := &BootSectorFat16{
-			BootSectorCommon:    bsCommon,
+			BootSectorCommon:    *bsCommon,
 			FileSystemTypeLabel: label,
-			VolumeLabel:         f.config.Label,
+			VolumeLabel:         volumeLabel,
+			BootCode:            f.config.BootCode,
 		}
 
 		// Write the boot sector
@@ -106,14 +148,13 @@ func (f *superFloppyFormatter) format() error {
 			return Fatal(err)
 		}
 	case FAT32:
-		bsCommon.SectorsPerFat = f.sectorsPerFat(0, sectorsPerCluster)
-
 		bs := &BootSectorFat32{
-			BootSectorCommon:    bsCommon,
+			BootSectorCommon:    *bsCommon,
 			FileSystemTypeLabel: "FAT32   ",
 			FSInfoSector:        1,
 			VolumeID:            uint32(time.Now().Unix()),
-			VolumeLabel:         f.config.Label,
+			VolumeLabel:         volumeLabel,
+			BootCode:            f.config.BootCode,
 		}
 
 		// Write the boot sector
@@ -128,40 +169,143 @@ func (f *superFloppyFormatter) format() error {
 
 		// TODO(mitchellh): Create the fsinfo structure
 		// TODO(mitchellh): write the boot sector copy
-	default:
-		return Fatalf("Unknown FAT type: %d", f.config.FATType)
 	}
 
 	// Create the FATs
-	fat, err := NewFAT(&bsCommon)
+	fat, err := NewFAT(bsCommon)
 	if err != nil {
 		return Fatal(err)
 	}
 
+	// Keep bad clusters out of use
+	if _, err := fat.markBad(bad); err != nil {
+		return Fatal(err)
+	}
+
 	// Write the FAT
 	if err := fat.WriteToDevice(f.device); err != nil {
 		return Fatal(err)
 	}
 
-	var rootDir *DirectoryCluster
-	if f.config.FATType == FAT32 {
-		panic("TODO")
-	} else {
-		rootDir, err = NewFat16RootDirectoryCluster(&bsCommon, f.config.Label)
+	rootDir, err := NewFat16RootDirectoryCluster(bsCommon, volumeLabel)
+	if err != nil {
+		return Fatal(err)
+	}
+
+	if err := rootDir.WriteToDevice(f.device, fat); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// badClusters returns the clusters of the new filesystem touched by the
+// configured bad blocks and, if asked for, the ones a surface scan
+// can't read.
+func (f *superFloppyFormatter) badClusters(bs *BootSectorCommon) ([]uint32, error) {
+	bad, err := badBlockClusters(bs, f.config.BadBlocks)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if f.config.ScanSurface {
+		unreadable, err := ScanSurface(f.device, bs)
 		if err != nil {
-			return Fatal(err)
+			return nil, Fatal(err)
 		}
 
-		offset := int64(bsCommon.RootDirOffset())
-		if _, err := f.device.WriteAt(rootDir.Bytes(), offset); err != nil {
-			return Fatal(err)
+		bad = append(bad, unreadable...)
+	}
+
+	return bad, nil
+}
+
+// layout returns the BIOS parameter block of the new filesystem. It
+// fails if the configuration doesn't give a valid filesystem of the
+// configured FAT type.
+func (f *superFloppyFormatter) layout() (*BootSectorCommon, error) {
+	floppy, err := f.FloppyFormat()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	f.floppy = floppy
+
+	sectorsPerCluster, err := f.SectorsPerCluster()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	bsCommon := BootSectorCommon{
+		BytesPerSector:      uint16(f.device.SectorSize()),
+		HiddenSectors:       f.config.HiddenSectors,
+		Media:               f.Media(),
+		NumFATs:             f.fatCount(),
+		NumHeads:            f.NumHeads(),
+		OEMName:             f.config.OEMName,
+		ReservedSectorCount: f.ReservedSectorCount(),
+		SectorsPerCluster:   sectorsPerCluster,
+		SectorsPerTrack:     f.SectorsPerTrack(),
+		TotalSectors:        uint32(f.device.Len() / int64(f.device.SectorSize())),
+	}
+
+	switch f.config.FATType {
+	case FAT12, FAT16:
+		bsCommon.RootEntryCount = f.RootEntryCount()
+
+		// Floppy formats have fixed values, as the calculations don't
+		// create a working image for older operating systems. They only
+		// apply as long as the layout isn't overridden.
+		if f.floppy != nil &&
+			sectorsPerCluster == f.floppy.SectorsPerCluster &&
+			bsCommon.ReservedSectorCount == 1 &&
+			bsCommon.NumFATs == 2 &&
+			bsCommon.RootEntryCount == f.floppy.RootEntryCount {
+			bsCommon.SectorsPerFat = f.floppy.SectorsPerFat
+		} else {
+			bsCommon.SectorsPerFat = f.sectorsPerFat(bsCommon.ReservedSectorCount, bsCommon.RootEntryCount, sectorsPerCluster)
 		}
+	case FAT32:
+		if f.config.RootEntryCount != 0 {
+			return nil, Fatalf("FAT32 has no fixed root directory, root entry count must be 0")
+		}
+
+		bsCommon.SectorsPerFat = f.sectorsPerFat(bsCommon.ReservedSectorCount, 0, sectorsPerCluster)
+	default:
+		return nil, Fatalf("Unknown FAT type: %d", f.config.FATType)
 	}
 
-	return nil
+	if f.config.Alignment != 0 {
+		if err := f.align(&bsCommon); err != nil {
+			return nil, Fatal(err)
+		}
+	}
+
+	if err := f.validate(&bsCommon); err != nil {
+		return nil, Fatal(err)
+	}
+
+	return &bsCommon, nil
+}
+
+// VolumeLabel returns the label in OEM bytes, padded with spaces.
+func (f *superFloppyFormatter) VolumeLabel() (string, error) {
+	label, err := f.config.CodePage.Encode(f.config.Label)
+	if err != nil {
+		return "", Fatal(err)
+	}
+
+	if len(label) > 11 {
+		return "", Fatalf("volume label %q longer than 11 bytes", f.config.Label)
+	}
+
+	return label + strings.Repeat(" ", 11-len(label)), nil
 }
 
 func (f *superFloppyFormatter) ReservedSectorCount() uint16 {
+	if f.config.ReservedSectors != 0 {
+		return f.config.ReservedSectors
+	}
+
 	if f.config.FATType == FAT32 {
 		return 32
 	} else {
@@ -169,7 +313,156 @@ func (f *superFloppyFormatter) ReservedSectorCount() uint16 {
 	}
 }
 
+// FloppyFormat returns the floppy format the device gets, or nil if it
+// isn't formatted as a floppy.
+func (f *superFloppyFormatter) FloppyFormat() (*FloppyFormat, error) {
+	if f.config.Floppy == "" {
+		if f.config.FATType != FAT12 || f.device.SectorSize() != 512 {
+			return nil, nil
+		}
+
+		return FloppyFormatBySize(f.device.Len()), nil
+	}
+
+	floppy, err := FloppyFormatByName(f.config.Floppy)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	if f.config.FATType != FAT12 {
+		return nil, Fatalf("floppy format %s must be FAT12", floppy.Name())
+	}
+
+	if f.device.SectorSize() != 512 || f.device.Len() != floppy.Size() {
+		return nil, Fatalf("floppy format %s needs a %d byte device with 512 byte sectors, got %d bytes",
+			floppy.Name(), floppy.Size(), f.device.Len())
+	}
+
+	return floppy, nil
+}
+
+// RootEntryCount returns the number of FAT12/16 root directory entries.
+func (f *superFloppyFormatter) RootEntryCount() uint16 {
+	switch {
+	case f.config.RootEntryCount != 0:
+		return f.config.RootEntryCount
+	case f.floppy != nil:
+		return f.floppy.RootEntryCount
+	case f.device.Len() > 512*5*32:
+		return 512
+	default:
+		return uint16(f.device.Len() / (5 * 32))
+	}
+}
+
+func (f *superFloppyFormatter) Media() MediaType {
+	switch {
+	case f.config.Media != 0:
+		return f.config.Media
+	case f.floppy != nil:
+		return f.floppy.Media
+	default:
+		return MediaFixed
+	}
+}
+
+func (f *superFloppyFormatter) SectorsPerTrack() uint16 {
+	switch {
+	case f.config.SectorsPerTrack != 0:
+		return f.config.SectorsPerTrack
+	case f.floppy != nil:
+		return f.floppy.SectorsPerTrack
+	default:
+		return 32
+	}
+}
+
+func (f *superFloppyFormatter) NumHeads() uint16 {
+	switch {
+	case f.config.NumHeads != 0:
+		return f.config.NumHeads
+	case f.floppy != nil:
+		return f.floppy.NumHeads
+	default:
+		return 16
+	}
+}
+
+// validate checks the layout of a new filesystem against the limits of
+// the FAT specification. The FAT type of a volume is determined by its
+// cluster count alone, so a layout outside the limits of the configured
+// type would be read back as another type.
+func (f *superFloppyFormatter) validate(bs *BootSectorCommon) error {
+	spc := bs.SectorsPerCluster
+	if spc == 0 || spc&(spc-1) != 0 {
+		return Fatalf("sectors per cluster %d not a power of two", spc)
+	}
+
+	if bs.BytesPerCluster() > 32*1024 {
+		return Fatalf("cluster size %d larger than 32K", bs.BytesPerCluster())
+	}
+
+	if bs.ReservedSectorCount == 0 {
+		return Fatalf("reserved sector count must be at least 1")
+	}
+
+	if bs.NumFATs == 0 {
+		return Fatalf("number of FATs must be at least 1")
+	}
+
+	if bs.Media != 0xF0 && bs.Media < 0xF8 {
+		return Fatalf("invalid media byte %#02x", uint8(bs.Media))
+	}
+
+	if f.config.FATType != FAT32 {
+		if bs.RootEntryCount == 0 {
+			return Fatalf("root entry count must be at least 1")
+		}
+
+		if f.config.RootEntryCount != 0 && (int(bs.RootEntryCount)*DirectoryEntrySize)%int(bs.BytesPerSector) != 0 {
+			return Fatalf("root entry count %d doesn't fill whole sectors", bs.RootEntryCount)
+		}
+	}
+
+	if bs.metadataSectors() >= uint64(bs.TotalSectors) {
+		return Fatalf("no data region in %d sectors", bs.TotalSectors)
+	}
+
+	clusters := bs.ClusterCount()
+	if fatType := bs.FATType(); fatType != f.config.FATType {
+		return Fatalf("%d clusters is outside the limits of %s, the volume would be %s",
+			clusters, f.config.FATType, fatType)
+	}
+
+	if clusters > MaxClustersFAT32 {
+		return Fatalf("%d clusters is more than %s can address", clusters, f.config.FATType)
+	}
+
+	for _, limit := range []uint32{MaxClustersFAT12, MaxClustersFAT16} {
+		if clusters+clusterCountMargin > limit && clusters <= limit+clusterCountMargin {
+			return Fatalf("%d clusters is too close to the %s limit of %d to be detected reliably",
+				clusters, f.config.FATType, limit)
+		}
+	}
+
+	// The layout is sound, but there is no way yet to create the FAT32
+	// root directory and FSInfo sector. Fail before anything is written.
+	if f.config.FATType == FAT32 {
+		return Fatalf("formatting %s: %w", f.config.FATType, errors.ErrUnsupported)
+	}
+
+	return nil
+}
+
 func (f *superFloppyFormatter) SectorsPerCluster() (uint8, error) {
+	if f.config.SectorsPerCluster != 0 {
+		return f.config.SectorsPerCluster, nil
+	}
+
+	if f.floppy != nil {
+		return f.floppy.SectorsPerCluster, nil
+	}
+
 	if f.config.FATType == FAT12 {
 		return f.defaultSectorsPerCluster12()
 	} else if f.config.FATType == FAT16 {
@@ -183,7 +476,7 @@ func (f *superFloppyFormatter) defaultSectorsPerCluster12() (uint8, error) {
 	var result uint8 = 1
 	sectors := f.device.Len() / int64(f.device.SectorSize())
 
-	for (sectors / int64(result)) > 4084 {
+	for (sectors / int64(result)) > MaxClustersFAT12-clusterCountMargin {
 		result *= 2
 		if int(result)*f.device.SectorSize() > 4096 {
 			return 0, Fatalf("disk too large for FAT12")
@@ -240,15 +533,67 @@ func (f *superFloppyFormatter) defaultSectorsPerCluster32() (uint8, error) {
 }
 
 func (f *superFloppyFormatter) fatCount() uint8 {
+	if f.config.NumFATs != 0 {
+		return f.config.NumFATs
+	}
+
 	return 2
 }
 
-func (f *superFloppyFormatter) sectorsPerFat(rootEntCount uint16, sectorsPerCluster uint8) uint32 {
+// align pads the reserved sectors so that the first FAT starts on an
+// alignment boundary and grows the FATs so that the data region does as
+// well. When no FAT size gets there, which happens if the root directory
+// has an odd number of sectors, only the data region is aligned.
+func (f *superFloppyFormatter) align(bs *BootSectorCommon) error {
+	bps := uint64(bs.BytesPerSector)
+	if uint64(f.config.Alignment)%bps != 0 {
+		return Fatalf("alignment %d not a multiple of the sector size %d", f.config.Alignment, bps)
+	}
+
+	alignment := uint64(f.config.Alignment) / bps
+	alignUp := func(n uint64) uint64 {
+		return (n + alignment - 1) / alignment * alignment
+	}
+
+	hidden := uint64(bs.HiddenSectors)
+	rootDirSectors := (uint64(bs.RootEntryCount)*DirectoryEntrySize + bps - 1) / bps
+	fats := uint64(bs.NumFATs)
+
+	reserved := alignUp(hidden+uint64(bs.ReservedSectorCount)) - hidden
+	if reserved > math.MaxUint16 {
+		return Fatalf("%d reserved sectors needed for alignment, at most %d possible", reserved, math.MaxUint16)
+	}
+
+	sectorsPerFat := uint64(f.sectorsPerFat(uint16(reserved), bs.RootEntryCount, bs.SectorsPerCluster))
+
+	aligned := false
+	for pad := uint64(0); pad < alignment; pad++ {
+		if (fats*(sectorsPerFat+pad)+rootDirSectors)%alignment == 0 {
+			sectorsPerFat += pad
+			aligned = true
+			break
+		}
+	}
+
+	if !aligned {
+		metadata := fats*sectorsPerFat + rootDirSectors
+		reserved = alignUp(hidden+reserved+metadata) - metadata - hidden
+		if reserved > math.MaxUint16 {
+			return Fatalf("%d reserved sectors needed for alignment, at most %d possible", reserved, math.MaxUint16)
+		}
+	}
+
+	bs.ReservedSectorCount = uint16(reserved)
+	bs.SectorsPerFat = uint32(sectorsPerFat)
+	return nil
+}
+
+func (f *superFloppyFormatter) sectorsPerFat(reserved uint16, rootEntCount uint16, sectorsPerCluster uint8) uint32 {
 	bytesPerSec := f.device.SectorSize()
 	totalSectors := int(f.device.Len()) / bytesPerSec
 	rootDirSectors := ((int(rootEntCount) * 32) + (bytesPerSec - 1)) / bytesPerSec
 
-	tmp1 := totalSectors - (int(f.ReservedSectorCount()) + rootDirSectors)
+	tmp1 := totalSectors - (int(reserved) + rootDirSectors)
 	tmp2 := (256 * int(sectorsPerCluster)) + int(f.fatCount())
 
 	if f.config.FATType == FAT32 {
@@ -0,0 +1,163 @@
+package fat
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rstms/ffs/internal/testdisk"
+)
+
+func TestFormatSuperFloppy_Overrides(t *testing.T) {
+	device := testdisk.New(make([]byte, 8*1024*1024))
+
+	formatConfig := &SuperFloppyConfig{
+		FATType:           FAT16,
+		Label:             "ffs",
+		OEMName:           "ffs",
+		SectorsPerCluster: 2,
+		ReservedSectors:   4,
+		NumFATs:           1,
+		RootEntryCount:    64,
+		Media:             0xFA,
+		SectorsPerTrack:   63,
+		NumHeads:          255,
+		HiddenSectors:     2048,
+	}
+	if err := FormatSuperFloppy(device, formatConfig); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSector(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if bs.SectorsPerCluster != 2 ||
+		bs.ReservedSectorCount != 4 ||
+		bs.NumFATs != 1 ||
+		bs.RootEntryCount != 64 ||
+		bs.Media != 0xFA ||
+		bs.SectorsPerTrack != 63 ||
+		bs.NumHeads != 255 ||
+		bs.HiddenSectors != 2048 {
+		t.Fatalf("bad boot sector: %+v", bs)
+	}
+	if bs.FATType() != FAT16 {
+		t.Fatalf("bad FAT type: %s", bs.FATType())
+	}
+
+	fatFs, err := New(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := fatFs.Create("test.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestFormatSuperFloppy_OverrideFloppy(t *testing.T) {
+	device := testdisk.New(make([]byte, 1440*1024))
+
+	formatConfig := &SuperFloppyConfig{
+		FATType:        FAT12,
+		Floppy:         "1.44M",
+		RootEntryCount: 112,
+	}
+	if err := FormatSuperFloppy(device, formatConfig); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSector(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if bs.RootEntryCount != 112 || bs.Media != 0xF0 || bs.SectorsPerTrack != 18 {
+		t.Fatalf("bad boot sector: %+v", bs)
+	}
+}
+
+func TestFormatSuperFloppy_InvalidOverrides(t *testing.T) {
+	cases := map[string]*SuperFloppyConfig{
+		"cluster size":       {FATType: FAT16, SectorsPerCluster: 3},
+		"cluster too large":  {FATType: FAT16, SectorsPerCluster: 128},
+		"media":              {FATType: FAT16, Media: 0xE0},
+		"partial sector":     {FATType: FAT16, RootEntryCount: 100},
+		"too few clusters":   {FATType: FAT16, SectorsPerCluster: 8},
+		"too many clusters":  {FATType: FAT12, SectorsPerCluster: 1},
+		"FAT32 root entries": {FATType: FAT32, RootEntryCount: 512},
+		"no data region":     {FATType: FAT16, ReservedSectors: 16384},
+	}
+
+	for name, formatConfig := range cases {
+		device := testdisk.New(make([]byte, 8*1024*1024))
+		if err := FormatSuperFloppy(device, formatConfig); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestFormatSuperFloppy_FAT32Unsupported(t *testing.T) {
+	device := testdisk.New(make([]byte, 64*1024*1024))
+	err := FormatSuperFloppy(device, &SuperFloppyConfig{FATType: FAT32})
+	if !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expected ErrUnsupported, got %v", err)
+	}
+	if device.Writes != 0 {
+		t.Fatalf("device written %d times", device.Writes)
+	}
+}
+
+func TestFormatSuperFloppy_Alignment(t *testing.T) {
+	const alignment = 4 * 1024 * 1024
+
+	cases := map[string]*SuperFloppyConfig{
+		"super floppy":    {FATType: FAT16},
+		"partition":       {FATType: FAT16, HiddenSectors: 63},
+		"odd root dir":    {FATType: FAT16, RootEntryCount: 16},
+		"one FAT":         {FATType: FAT16, NumFATs: 1, HiddenSectors: 2048},
+		"FAT12 partition": {FATType: FAT12, HiddenSectors: 1},
+	}
+
+	for name, formatConfig := range cases {
+		size := int64(64 * 1024 * 1024)
+		if formatConfig.FATType == FAT12 {
+			size = 12 * 1024 * 1024
+		}
+		device := testdisk.New(make([]byte, size))
+
+		formatConfig.Alignment = alignment
+		if err := FormatSuperFloppy(device, formatConfig); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		bs, err := DecodeBootSector(device)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		hidden := int64(bs.HiddenSectors) * int64(bs.BytesPerSector)
+		if (hidden+int64(bs.DataOffset()))%alignment != 0 {
+			t.Fatalf("%s: data region at %d not aligned", name, bs.DataOffset())
+		}
+
+		// The root directory of 16 entries has an odd number of sectors
+		if name != "odd root dir" && (hidden+int64(bs.FATOffset(0)))%alignment != 0 {
+			t.Fatalf("%s: FAT at %d not aligned", name, bs.FATOffset(0))
+		}
+
+		fatFs, err := New(device)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, err := fatFs.Create("test.txt"); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+
+	device := testdisk.New(make([]byte, 64*1024*1024))
+	formatConfig := &SuperFloppyConfig{FATType: FAT16, Alignment: 1000}
+	if err := FormatSuperFloppy(device, formatConfig); err == nil {
+		t.Fatal("expected error for alignment not a multiple of the sector size")
+	}
+}
@@ -1,6 +1,10 @@
 package fat
 
-import "github.com/rstms/ffs"
+import (
+	"fmt"
+
+	"github.com/rstms/ffs"
+)
 
 // FATType is a simple enum of the available FAT filesystem types.
 type FATType uint8
@@ -11,16 +15,34 @@ const (
 	FAT32
 )
 
-// TypeForDevice determines the usable FAT type based solely on
-// size information about the block device.
-func TypeForDevice(device ffs.BlockDevice) FATType {
-	sizeInMB := device.Len() / (1024 * 1024)
-	switch {
-	case sizeInMB < 4:
-		return FAT12
-	case sizeInMB < 512:
-		return FAT16
+func (t FATType) String() string {
+	switch t {
+	case FAT12:
+		return "FAT12"
+	case FAT16:
+		return "FAT16"
+	case FAT32:
+		return "FAT32"
 	default:
-		return FAT32
+		return fmt.Sprintf("FATType(%d)", uint8(t))
 	}
 }
+
+// TypeForDevice determines the FAT type a super floppy format of the
+// block device gets. The type follows from the count of data clusters,
+// so it is the smallest one with a valid cluster count for the default
+// layout of the device.
+func TypeForDevice(device ffs.BlockDevice) FATType {
+	for _, fatType := range []FATType{FAT12, FAT16} {
+		formatter := &superFloppyFormatter{
+			config: &SuperFloppyConfig{FATType: fatType},
+			device: device,
+		}
+
+		if _, err := formatter.layout(); err == nil {
+			return fatType
+		}
+	}
+
+	return FAT32
+}
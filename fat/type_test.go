@@ -0,0 +1,90 @@
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/rstms/ffs/internal/testdisk"
+)
+
+func TestTypeForDevice(t *testing.T) {
+	cases := []struct {
+		size     int64
+		expected FATType
+	}{
+		{360 * 1024, FAT12},
+		{1440 * 1024, FAT12},
+		{8 * 1024 * 1024, FAT12},
+		{64 * 1024 * 1024, FAT16},
+		{600 * 1024 * 1024, FAT16},
+		{4 * 1024 * 1024 * 1024, FAT32},
+	}
+
+	for _, tc := range cases {
+		device := testdisk.New(make([]byte, tc.size))
+		if fatType := TypeForDevice(device); fatType != tc.expected {
+			t.Fatalf("%d: expected %s, got %s", tc.size, tc.expected, fatType)
+		}
+	}
+}
+
+func TestFormatSuperFloppy_AmbiguousClusterCount(t *testing.T) {
+	// 8M with 4 sectors per cluster is about 4090 clusters, just above
+	// the FAT12 limit
+	for _, fatType := range []FATType{FAT12, FAT16} {
+		device := testdisk.New(make([]byte, 8*1024*1024))
+		formatConfig := &SuperFloppyConfig{
+			FATType:           fatType,
+			SectorsPerCluster: 4,
+		}
+		if err := FormatSuperFloppy(device, formatConfig); err == nil {
+			t.Fatalf("%s: expected error", fatType)
+		}
+	}
+}
+
+func TestDecodeBootSector_ClusterCount(t *testing.T) {
+	device := testdisk.New(make([]byte, 8*1024*1024))
+	formatConfig := &SuperFloppyConfig{
+		FATType:           FAT16,
+		SectorsPerCluster: 2,
+	}
+	if err := FormatSuperFloppy(device, formatConfig); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var sector [512]byte
+	if _, err := device.ReadAt(sector[:], 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bs, err := DecodeBootSector(device)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if bs.FATType() != FAT16 {
+		t.Fatalf("bad FAT type: %s", bs.FATType())
+	}
+
+	corrupt := map[string]func(data []byte){
+		"no root directory": func(data []byte) {
+			binary.LittleEndian.PutUint16(data[17:19], 0)
+		},
+		"FAT too small": func(data []byte) {
+			binary.LittleEndian.PutUint16(data[22:24], 1)
+		},
+	}
+
+	for name, fn := range corrupt {
+		data := sector
+		fn(data[:])
+		if _, err := device.WriteAt(data[:], 0); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if _, err := DecodeBootSector(device); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("%s: expected ErrCorrupt, got %v", name, err)
+		}
+	}
+}
@@ -2,17 +2,24 @@ package ffs
 
 import (
 	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 )
 
+// ErrReadOnly is returned when writing to a read-only block device. The
+// read-only errors of the filesystem packages wrap it.
+var ErrReadOnly = fmt.Errorf("read-only block device: %w", fs.ErrPermission)
+
 // A FileDisk is an implementation of a BlockDevice that uses a
 // *os.File as its backing store.
 type FileDisk struct {
-	f    *os.File
-	size int64
+	f        *os.File
+	size     int64
+	readOnly bool
 }
 
-var _ BlockDevice = (*FileDisk)(nil)
+var _ ReadOnlyDevice = (*FileDisk)(nil)
 
 // NewFileDisk creates a new FileDisk from the given *os.File. The
 // file must already be created and set the to the proper size.
@@ -32,6 +39,18 @@ func NewFileDisk(f *os.File) (*FileDisk, error) {
 	}, nil
 }
 
+// NewReadOnlyFileDisk creates a new FileDisk from the given *os.File
+// that refuses all writes. The file may be opened with os.O_RDONLY.
+func NewReadOnlyFileDisk(f *os.File) (*FileDisk, error) {
+	result, err := NewFileDisk(f)
+	if err != nil {
+		return nil, err
+	}
+
+	result.readOnly = true
+	return result, nil
+}
+
 func (f *FileDisk) Close() error {
 	return f.f.Close()
 }
@@ -44,11 +63,19 @@ func (f *FileDisk) ReadAt(p []byte, off int64) (int, error) {
 	return f.f.ReadAt(p, off)
 }
 
+func (f *FileDisk) ReadOnly() bool {
+	return f.readOnly
+}
+
 func (f *FileDisk) SectorSize() int {
 	// Hardcoded for now, one day we may want to make this customizable
 	return 512
 }
 
 func (f *FileDisk) WriteAt(p []byte, off int64) (int, error) {
+	if f.readOnly {
+		return 0, ErrReadOnly
+	}
+
 	return f.f.WriteAt(p, off)
 }
@@ -1,6 +1,7 @@
 package ffs
 
 import (
+	"errors"
 	"os"
 	"testing"
 )
@@ -25,3 +26,33 @@ func TestFileDisk_NewDiskFile_Dir(t *testing.T) {
 		t.Fatal("should error if directory")
 	}
 }
+
+func TestFileDisk_ReadOnly(t *testing.T) {
+	f, err := os.CreateTemp("", "ffs")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := f.Truncate(4096); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	disk, err := NewReadOnlyFileDisk(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !disk.ReadOnly() {
+		t.Fatal("disk should be read-only")
+	}
+
+	if _, err := disk.WriteAt([]byte{1}, 0); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	if _, err := disk.ReadAt(make([]byte, 512), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
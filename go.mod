@@ -5,6 +5,7 @@ go 1.25.1
 require (
 	github.com/rstms/go-common v0.2.50
 	github.com/stretchr/testify v1.11.1
+	golang.org/x/text v0.21.0
 )
 
 require (
@@ -26,6 +27,5 @@ require (
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -3,15 +3,23 @@
 package image
 
 import (
+	"errors"
+	"fmt"
+
+	"github.com/rstms/ffs/internal/fatal"
 	"github.com/rstms/go-common"
 )
 
 func Fatal(err error) error {
-	return common.Fatal(err)
+	return fatal.Wrap(common.Fatal(err), err)
 }
 
 func Fatalf(format string, args ...interface{}) error {
-	return common.Fatalf(format, args...)
+	err := fmt.Errorf(format, args...)
+	if errors.Unwrap(err) == nil {
+		return common.Fatalf(format, args...)
+	}
+	return fatal.Wrap(common.Fatal(err), err)
 }
 
 func IsFile(filename string) bool {
@@ -1,10 +1,11 @@
 package image
 
 import (
-	//"bytes"
-	"bytes"
+	"errors"
+	"fmt"
 	"github.com/rstms/ffs"
 	"github.com/rstms/ffs/fat"
+	"github.com/rstms/ffs/mbr"
 	"io"
 	"io/fs"
 	"os"
@@ -25,16 +26,143 @@ type FileRecord struct {
 }
 
 type Image struct {
-	Filename string
-	file     *os.File
-	disk     *ffs.FileDisk
-	fs       *fat.FileSystem
+	Filename  string
+	file      *os.File
+	disk      *ffs.FileDisk
+	fs        *fat.FileSystem
+	mbr       *mbr.MBR
+	partition int
+	closed    bool
+}
+
+// PartitionConfig describes the partition of an image with a master
+// boot record.
+type PartitionConfig struct {
+	// The first sector of the partition. Defaults to 2048, at 1MiB.
+	Start uint32
+
+	// The partition type. Defaults to the type for the FAT type.
+	Type uint8
+
+	// Marks the partition active so that the BIOS boots from it.
+	Active bool
+
+	// The MBR boot code, at most 440 bytes.
+	Bootstrap []byte
+
+	// The disk signature.
+	DiskSignature uint32
 }
 
 func OpenImage(filename string) (*Image, error) {
+	return OpenImageWithConfig(filename, nil)
+}
+
+// OpenImageReadOnly opens an image without write access. Every call that
+// would modify the image fails with fat.ErrReadOnly.
+func OpenImageReadOnly(filename string) (*Image, error) {
+	return OpenImageWithConfig(filename, &fat.Config{ReadOnly: true})
+}
+
+// OpenImageWithConfig opens an image with the given filesystem
+// configuration, e.g. the OEM code page of its short names and label.
+// A nil config uses the defaults.
+func OpenImageWithConfig(filename string, config *fat.Config) (*Image, error) {
+	if config == nil {
+		config = &fat.Config{}
+	}
 	i := Image{Filename: filename}
 	var err error
-	i.file, err = os.OpenFile(filename, os.O_RDWR, 0600)
+	if config.ReadOnly {
+		i.file, err = os.Open(filename)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		i.disk, err = ffs.NewReadOnlyFileDisk(i.file)
+	} else {
+		i.file, err = os.OpenFile(filename, os.O_RDWR, 0600)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		i.disk, err = ffs.NewFileDisk(i.file)
+	}
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	err = i.openFileSystem(config)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return &i, nil
+}
+
+// openFileSystem opens the FAT filesystem of the image. A partitioned
+// image has it in the active partition, or else in the first one.
+func (i *Image) openFileSystem(config *fat.Config) error {
+	var err error
+	i.fs, err = fat.NewWithConfig(i.disk, config)
+	if err == nil {
+		return nil
+	}
+	table, mbrErr := mbr.Decode(i.disk)
+	if mbrErr != nil {
+		return Fatal(err)
+	}
+	n := table.Active()
+	if n < 0 {
+		for n = range table.Partitions {
+			if !table.Partitions[n].Empty() {
+				break
+			}
+		}
+	}
+	part, err := table.Device(i.disk, n)
+	if err != nil {
+		return Fatal(err)
+	}
+	i.fs, err = fat.NewWithConfig(part, config)
+	if err != nil {
+		return Fatal(err)
+	}
+	i.mbr = table
+	i.partition = n
+	return nil
+}
+
+// CreateImage creates and formats a new image of the given size. A
+// FAT12 image of the size of a standard floppy gets that floppy format;
+// use CreateImageWithConfig to select a format by name or to set any
+// other formatting option.
+func CreateImage(filename, volumeLabel, oemName string, fatType int, size int64) (*Image, error) {
+	ftype, err := formatType(fatType)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	formatConfig := &fat.SuperFloppyConfig{
+		FATType: ftype,
+		Label:   volumeLabel,
+		OEMName: oemName,
+	}
+	i, err := CreateImageWithConfig(filename, size, formatConfig)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return i, nil
+}
+
+// CreateImageWithConfig creates and formats a new image. If the config
+// selects a floppy format, a size of 0 uses the size of the format.
+func CreateImageWithConfig(filename string, size int64, config *fat.SuperFloppyConfig) (*Image, error) {
+	if size == 0 && config.Floppy != "" {
+		floppy, err := fat.FloppyFormatByName(config.Floppy)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		size = floppy.Size()
+	}
+	i := Image{Filename: filename}
+	var err error
+	err = i.createImageFile(size)
 	if err != nil {
 		return nil, Fatal(err)
 	}
@@ -42,14 +170,25 @@ func OpenImage(filename string) (*Image, error) {
 	if err != nil {
 		return nil, Fatal(err)
 	}
-	i.fs, err = fat.New(i.disk)
+	err = fat.FormatSuperFloppy(i.disk, config)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	i.fs, err = fat.NewWithConfig(i.disk, &fat.Config{CodePage: config.CodePage})
 	if err != nil {
 		return nil, Fatal(err)
 	}
 	return &i, nil
 }
 
-func CreateImage(filename, volumeLabel, oemName string, fatType int, size int64) (*Image, error) {
+// CreatePartitionedImage creates an image with a master boot record and
+// a single partition that runs to the end of the image, and formats the
+// partition.
+func CreatePartitionedImage(filename string, size int64, partition *PartitionConfig, config *fat.SuperFloppyConfig) (*Image, error) {
+	start := partition.Start
+	if start == 0 {
+		start = 2048
+	}
 	i := Image{Filename: filename}
 	var err error
 	err = i.createImageFile(size)
@@ -60,17 +199,170 @@ func CreateImage(filename, volumeLabel, oemName string, fatType int, size int64)
 	if err != nil {
 		return nil, Fatal(err)
 	}
-	err = i.format(fatType, volumeLabel, oemName)
+	sectors := i.disk.Len() / int64(i.disk.SectorSize())
+	if sectors <= int64(start) {
+		return nil, Fatalf("image of %d sectors too small for a partition at sector %d", sectors, start)
+	}
+	table := &mbr.MBR{DiskSignature: partition.DiskSignature}
+	err = table.SetBootstrap(partition.Bootstrap)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	ptype := partition.Type
+	if ptype == 0 {
+		ptype = partitionType(config.FATType, uint32(sectors))
+	}
+	table.Partitions[0] = mbr.Partition{
+		Active:  partition.Active,
+		Type:    ptype,
+		Start:   start,
+		Sectors: uint32(sectors) - start,
+	}
+	err = table.Write(i.disk)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	part, err := table.Device(i.disk, 0)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	formatConfig := *config
+	if formatConfig.HiddenSectors == 0 {
+		formatConfig.HiddenSectors = start
+	}
+	err = fat.FormatSuperFloppy(part, &formatConfig)
 	if err != nil {
 		return nil, Fatal(err)
 	}
-	i.fs, err = fat.New(i.disk)
+	i.fs, err = fat.NewWithConfig(part, &fat.Config{CodePage: config.CodePage})
 	if err != nil {
 		return nil, Fatal(err)
 	}
+	i.mbr = table
 	return &i, nil
 }
 
+// partitionType returns the MBR partition type for a FAT filesystem on
+// a disk that ends at the given sector.
+func partitionType(fatType fat.FATType, end uint32) uint8 {
+	switch {
+	case fatType == fat.FAT12:
+		return mbr.TypeFAT12
+	case fatType == fat.FAT32:
+		return mbr.TypeFAT32LBA
+	case end > 1024*255*63:
+		return mbr.TypeFAT16LBA
+	case end < 65536:
+		return mbr.TypeFAT16Small
+	default:
+		return mbr.TypeFAT16
+	}
+}
+
+// createImageLike creates an image with the layout of src: a super
+// floppy, or a single partition at the same sector with the same MBR
+// boot code, disk signature and active flag. Other partitions of src
+// are not copied. The new image uses the code page of src.
+func createImageLike(filename string, src *Image, volumeLabel, oemName string, fatType int, size int64) (*Image, error) {
+	ftype, err := formatType(fatType)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	formatConfig := &fat.SuperFloppyConfig{
+		FATType:  ftype,
+		Label:    volumeLabel,
+		OEMName:  oemName,
+		CodePage: src.fs.CodePage(),
+	}
+	if src.mbr == nil {
+		return CreateImageWithConfig(filename, size, formatConfig)
+	}
+	p := src.mbr.Partitions[src.partition]
+	partition := &PartitionConfig{
+		Start:         p.Start,
+		Active:        p.Active,
+		Bootstrap:     src.mbr.Bootstrap[:],
+		DiskSignature: src.mbr.DiskSignature,
+	}
+	srcType, err := src.FATType()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	if srcType == fatType {
+		partition.Type = p.Type
+	}
+	i, err := CreatePartitionedImage(filename, size, partition, formatConfig)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return i, nil
+}
+
+// MBR returns the master boot record of a partitioned image, or nil.
+func (i *Image) MBR() *mbr.MBR {
+	return i.mbr
+}
+
+// updateMBR lets update modify the master boot record and writes it.
+// It fails with fat.ErrClosed after Close and with fat.ErrReadOnly for
+// an image opened read-only, like the filesystem calls.
+func (i *Image) updateMBR(update func(table *mbr.MBR) error) error {
+	if i.closed {
+		return Fatalf("%s: %w", i.Filename, fat.ErrClosed)
+	}
+	if i.fs.ReadOnly() {
+		return Fatalf("%s: %w", i.Filename, fat.ErrReadOnly)
+	}
+	if i.mbr == nil {
+		return Fatalf("%s: %w", i.Filename, mbr.ErrNoMBR)
+	}
+	table := *i.mbr
+	err := update(&table)
+	if err != nil {
+		return Fatal(err)
+	}
+	err = table.Write(i.disk)
+	if err != nil {
+		return Fatal(err)
+	}
+	*i.mbr = table
+	return nil
+}
+
+// SetMBRBootstrap installs the boot code of the master boot record.
+func (i *Image) SetMBRBootstrap(code []byte) error {
+	err := i.updateMBR(func(table *mbr.MBR) error {
+		return table.SetBootstrap(code)
+	})
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+// SetDiskSignature sets the disk signature of the master boot record.
+func (i *Image) SetDiskSignature(signature uint32) error {
+	err := i.updateMBR(func(table *mbr.MBR) error {
+		table.DiskSignature = signature
+		return nil
+	})
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+// SetActivePartition marks partition n active, or none if n is -1.
+func (i *Image) SetActivePartition(n int) error {
+	err := i.updateMBR(func(table *mbr.MBR) error {
+		return table.SetActive(n)
+	})
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
 func (i *Image) closeFile() error {
 	if i.file != nil {
 		err := i.file.Close()
@@ -93,9 +385,17 @@ func (i *Image) closeDisk() error {
 	return nil
 }
 
+// Close marks the filesystem clean and closes the image file.
 func (i *Image) Close() error {
+	i.closed = true
 	defer i.closeDisk()
 	defer i.closeFile()
+	if i.fs != nil {
+		err := i.fs.Close()
+		if err != nil {
+			return Fatal(err)
+		}
+	}
 	return nil
 }
 
@@ -122,23 +422,12 @@ func (i *Image) AddFile(dstPathname, srcPathname string) error {
 	if err != nil {
 		return Fatal(err)
 	}
-	dstDir, dstName := filepath.Split(dstPathname)
-
-	dir, err := i.getDir(dstDir)
-	if err != nil {
-		return Fatal(err)
-	}
-
-	entry, err := dir.AddFile(dstName)
-	if err != nil {
-		return Fatal(err)
-	}
 	src, err := os.Open(srcPathname)
 	if err != nil {
 		return Fatal(err)
 	}
 	defer src.Close()
-	dst, err := entry.File()
+	dst, err := i.fs.OpenFile(dstPathname, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
 	if err != nil {
 		return Fatal(err)
 	}
@@ -154,6 +443,12 @@ func (i *Image) AddFile(dstPathname, srcPathname string) error {
 }
 
 func MungeImage(dstFilename, srcFilename string, basename string, files []string) error {
+	return MungeImageWithCodePage(dstFilename, srcFilename, basename, files, fat.CP437)
+}
+
+// MungeImageWithCodePage is MungeImage for an image whose short names and
+// label use the given OEM code page. The munged image uses it too.
+func MungeImageWithCodePage(dstFilename, srcFilename string, basename string, files []string, codePage fat.CodePage) error {
 
 	srcFileInfo, err := os.Stat(srcFilename)
 	if err != nil {
@@ -172,7 +467,7 @@ func MungeImage(dstFilename, srcFilename string, basename string, files []string
 		}
 	*/
 
-	srcImage, err := OpenImage(srcFilename)
+	srcImage, err := OpenImageWithConfig(srcFilename, &fat.Config{ReadOnly: true, CodePage: codePage})
 	if err != nil {
 		return Fatal(err)
 	}
@@ -191,29 +486,25 @@ func MungeImage(dstFilename, srcFilename string, basename string, files []string
 		return Fatal(err)
 	}
 
-	dstImage, err := CreateImage(dstFilename, volume, oem, fatType, size)
+	dstImage, err := createImageLike(dstFilename, srcImage, volume, oem, fatType, size)
 	if err != nil {
 		return Fatal(err)
 	}
 	defer dstImage.Close()
 
+	err = copyBootCode(dstImage, srcImage)
+	if err != nil {
+		return Fatal(err)
+	}
+
 	records, err := srcImage.ScanFiles()
 	if err != nil {
 		return Fatal(err)
 	}
 
-	for _, record := range records {
-		if !record.Dir {
-			err := copyFile(dstImage, srcImage, record)
-			if err != nil {
-				return Fatal(err)
-			}
-		} else {
-			err := dstImage.Mkdir(record.Name)
-			if err != nil {
-				return Fatal(err)
-			}
-		}
+	err = copyFiles(dstImage, srcImage, records)
+	if err != nil {
+		return Fatal(err)
 	}
 
 	for _, file := range files {
@@ -231,35 +522,32 @@ func MungeImage(dstFilename, srcFilename string, basename string, files []string
 }
 
 func copyFile(dst, src *Image, record FileRecord) error {
-	path, name := filepath.Split(record.Name)
-	srcDir, err := src.getDir(path)
-	if err != nil {
-		return Fatal(err)
-	}
-	srcEntry := srcDir.Entry(name)
-	if srcEntry == nil {
-		return Fatalf("src not found: %s", record.Name)
-	}
-	srcFile, err := srcEntry.File()
+	srcFile, err := src.fs.Open(record.Name)
 	if err != nil {
 		return Fatal(err)
 	}
 	defer srcFile.Close()
-	dstDir, err := dst.getDir(path)
+	dstFile, err := dst.fs.OpenFile(record.Name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
 	if err != nil {
 		return Fatal(err)
 	}
-	dstEntry, err := dstDir.AddFile(name)
+	defer dstFile.Close()
+
+	_, err = io.Copy(dstFile, srcFile)
 	if err != nil {
 		return Fatal(err)
 	}
-	dstFile, err := dstEntry.File()
+	err = setRecordAttrs(dst, record)
 	if err != nil {
 		return Fatal(err)
 	}
-	defer dstFile.Close()
+	return nil
+}
 
-	_, err = io.Copy(dstFile, srcFile)
+// setRecordAttrs sets the hidden, system and read-only attributes of
+// the record on its file in dst.
+func setRecordAttrs(dst *Image, record FileRecord) error {
+	dstEntry, err := dst.fs.Lookup(record.Name)
 	if err != nil {
 		return Fatal(err)
 	}
@@ -284,75 +572,150 @@ func copyFile(dst, src *Image, record FileRecord) error {
 	return nil
 }
 
-func (i *Image) searchDir(name string) (ffs.Directory, error) {
-	dir, err := i.fs.RootDir()
+// copyFiles copies the files and directories of the records from src
+// to dst. Pinned files are copied first, to the same sectors, so that
+// the sector list a boot loader keeps in its boot sector stays valid.
+func copyFiles(dst, src *Image, records []FileRecord) error {
+	pinned, err := copyPinnedFiles(dst, src, records)
 	if err != nil {
-		return nil, Fatal(err)
+		return Fatal(err)
+	}
+	for _, record := range records {
+		switch {
+		case pinned[record.Name]:
+		case record.Dir:
+			// Parents of pinned files already exist
+			isDir, err := dst.IsDir(record.Name)
+			if err != nil {
+				return Fatal(err)
+			}
+			if !isDir {
+				err := dst.Mkdir(record.Name)
+				if err != nil {
+					return Fatal(err)
+				}
+			}
+			err = setRecordAttrs(dst, record)
+			if err != nil {
+				return Fatal(err)
+			}
+		default:
+			err := copyFile(dst, src, record)
+			if err != nil {
+				return Fatal(err)
+			}
+		}
 	}
-	name = strings.Trim(name, "/")
-	if name == "" {
-		//log.Println("root exists")
-		return dir, nil
-	}
-	subdirs := strings.Split(name, "/")
-	//log.Printf("subdirs: %d %+v\n", len(subdirs), subdirs)
-	for _, sub := range subdirs {
-		//log.Printf("checking sub[%d]: %s\n", i, sub)
-		entry := dir.Entry(sub)
-		if entry == nil {
-			// no entry present with this name
-			//log.Printf("sub=%s not found\n", sub)
-			return nil, nil
+	return nil
+}
+
+// copyPinnedFiles recreates the pinned files of src at the same sectors
+// in dst and returns their names. Files with the attributes of
+// fat.PinAttr count as pinned if they are contiguous.
+func copyPinnedFiles(dst, src *Image, records []FileRecord) (map[string]bool, error) {
+	pinned := map[string]bool{}
+	for _, record := range records {
+		if record.Dir || !record.System || !record.Hidden || !record.ReadOnly {
+			continue
+		}
+		sectors, err := src.FileSectors(record.Name)
+		if err != nil {
+			return nil, Fatal(err)
+		}
+		if len(sectors) == 0 || !fat.Contiguous(sectors) {
+			continue
 		}
-		if !entry.IsDir() {
-			// entry found, but not a directory
-			//log.Printf("sub=%s entry=%s not a dir\n", sub, entry.Name())
-			return nil, nil
+		data, err := src.ReadFile(record.Name)
+		if err != nil {
+			return nil, Fatal(err)
 		}
-		// step to the next directory
-		//log.Printf("sub=%s entry=%s is dir, descending\n", sub, entry.Name())
-		dir, err = entry.Dir()
+		err = dst.fs.PinFileAt(record.Name, sectors[0], data)
 		if err != nil {
 			return nil, Fatal(err)
 		}
+		pinned[record.Name] = true
 	}
-	return dir, nil
+	return pinned, nil
 }
 
-func (i *Image) getDir(name string) (ffs.Directory, error) {
-	dir, err := i.searchDir(name)
+// PinFile makes the file contiguous, marks it system, hidden and
+// read-only, and returns its sectors relative to the start of the
+// volume. MungeImage and RewriteImage keep pinned files at the same
+// sectors.
+func (i *Image) PinFile(filename string) ([]uint32, error) {
+	sectors, err := i.fs.PinFile(filename)
 	if err != nil {
 		return nil, Fatal(err)
 	}
-	if dir == nil {
-		return nil, Fatalf("directory not found: %s", name)
+	return sectors, nil
+}
+
+// FileSectors returns the sectors of the file relative to the start of
+// the volume.
+func (i *Image) FileSectors(filename string) ([]uint32, error) {
+	sectors, err := i.fs.FileSectors(filename)
+	if err != nil {
+		return nil, Fatal(err)
 	}
-	return dir, nil
+	return sectors, nil
 }
 
-func (i *Image) IsDir(name string) (bool, error) {
-	dir, err := i.searchDir(name)
+// Extent is a fat.Extent of an image file. DiskOffset is its byte
+// offset in the image file, which adds the start of the partition the
+// filesystem was opened on to Offset.
+type Extent struct {
+	fat.Extent
+	DiskOffset int64
+}
+
+// FileExtents returns the runs of contiguous clusters holding the file.
+func (i *Image) FileExtents(filename string) ([]Extent, error) {
+	extents, err := i.fs.FileExtents(filename)
 	if err != nil {
-		return false, Fatal(err)
+		return nil, Fatal(err)
 	}
-	return dir != nil, nil
+	start := i.partitionOffset()
+	result := make([]Extent, len(extents))
+	for n, extent := range extents {
+		result[n] = Extent{Extent: extent, DiskOffset: start + extent.Offset}
+	}
+	return result, nil
 }
 
-func (i *Image) Mkdir(pathname string) error {
-	//log.Printf("Mkdir: %s\n", pathname)
-	exists, err := i.IsDir(pathname)
+// partitionOffset returns the byte offset in the image file of the
+// partition holding the filesystem, or 0 for a super floppy. It comes
+// from the master boot record, not the hidden sectors of the boot
+// sector, which can be set to anything.
+func (i *Image) partitionOffset() int64 {
+	if i.mbr == nil {
+		return 0
+	}
+	return int64(i.mbr.Partitions[i.partition].Start) * int64(i.disk.SectorSize())
+}
+
+// AllocationMap returns the state and owner of every cluster of the
+// image, for finding fragmented files and leaked clusters.
+func (i *Image) AllocationMap() (*fat.AllocationMap, error) {
+	m, err := i.fs.AllocationMap()
 	if err != nil {
-		return Fatal(err)
+		return nil, Fatal(err)
 	}
-	if exists {
-		return Fatalf("directory exists: %s", pathname)
+	return m, nil
+}
+
+func (i *Image) IsDir(name string) (bool, error) {
+	info, err := i.fs.Stat(name)
+	if errors.Is(err, fat.ErrNotExist) || errors.Is(err, fat.ErrNotDir) {
+		return false, nil
 	}
-	dir, name := filepath.Split(pathname)
-	parent, err := i.getDir(dir)
 	if err != nil {
-		return Fatal(err)
+		return false, Fatal(err)
 	}
-	_, err = parent.AddDirectory(name)
+	return info.IsDir(), nil
+}
+
+func (i *Image) Mkdir(pathname string) error {
+	err := i.fs.Mkdir(pathname)
 	if err != nil {
 		return Fatal(err)
 	}
@@ -384,28 +747,16 @@ func (i *Image) createImageFile(size int64) error {
 	return nil
 }
 
-func (i *Image) format(fatType int, volumeLabel, oemName string) error {
-	var ftype fat.FATType
+func formatType(fatType int) (fat.FATType, error) {
 	switch fatType {
 	case 12:
-		ftype = fat.FAT12
+		return fat.FAT12, nil
 	case 16:
-		ftype = fat.FAT16
+		return fat.FAT16, nil
 	case 32:
-		ftype = fat.FAT32
-	default:
-		return Fatalf("FAT type not 12,16,or 32")
+		return fat.FAT32, nil
 	}
-	formatConfig := &fat.SuperFloppyConfig{
-		FATType: ftype,
-		Label:   volumeLabel,
-		OEMName: oemName,
-	}
-	err := fat.FormatSuperFloppy(i.disk, formatConfig)
-	if err != nil {
-		return Fatal(err)
-	}
-	return nil
+	return 0, Fatalf("FAT type not 12,16,or 32")
 }
 
 func walk(path string, dir ffs.Directory) ([]FileRecord, error) {
@@ -443,30 +794,50 @@ func walk(path string, dir ffs.Directory) ([]FileRecord, error) {
 }
 
 func (i *Image) ReadFile(filename string) ([]byte, error) {
-
-	path, name := filepath.Split(filename)
-
-	dir, err := i.getDir(path)
-
-	entry := dir.Entry(name)
-	if entry == nil {
-		return []byte{}, Fatalf("not found: %s", filename)
-	}
-	src, err := entry.File()
+	src, err := i.fs.Open(filename)
 	if err != nil {
 		return []byte{}, Fatal(err)
 	}
+	defer src.Close()
 
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, src)
+	data, err := io.ReadAll(src)
 	if err != nil {
 		return []byte{}, Fatal(err)
 	}
-	return buf.Bytes(), nil
+	return data, nil
+}
+
+// ImportOptions controls how Import maps host files into the image.
+type ImportOptions struct {
+	// Sanitize maps host names that are not legal FAT names to legal
+	// ones instead of failing the import.
+	Sanitize bool
+}
+
+// RenamedFile records a host file that was imported under another name.
+type RenamedFile struct {
+	Source string
+	Name   string
 }
 
 // write all files in a directory to the image
 func (i *Image) Import(filename string) error {
+	_, err := i.ImportWithOptions(filename, ImportOptions{})
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+// ImportWithOptions writes all files in a directory to the image and
+// returns the files that had to be renamed.
+func (i *Image) ImportWithOptions(filename string, options ImportOptions) ([]RenamedFile, error) {
+	renamed := []RenamedFile{}
+	// image paths of the directories imported so far, by host path
+	dirs := map[string]string{filepath.Clean(filename): ""}
+	// legal names of the host directories, which sanitized names must
+	// not take from files that are imported later
+	legal := map[string]map[string]bool{}
 	err := filepath.WalkDir(filename, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return Fatal(err)
@@ -474,9 +845,20 @@ func (i *Image) Import(filename string) error {
 		if path == filename {
 			return nil
 		}
-		dst, err := filepath.Rel(filename, path)
-		if err != nil {
-			return Fatal(err)
+		dst := filepath.ToSlash(filepath.Join(dirs[filepath.Dir(path)], d.Name()))
+		if options.Sanitize && fat.ValidateName(d.Name()) != nil {
+			hostDir := filepath.Dir(path)
+			if legal[hostDir] == nil {
+				legal[hostDir], err = legalNames(hostDir)
+				if err != nil {
+					return Fatal(err)
+				}
+			}
+			dst, err = i.sanitizedPath(dirs[hostDir], d.Name(), legal[hostDir])
+			if err != nil {
+				return Fatal(err)
+			}
+			renamed = append(renamed, RenamedFile{Source: path, Name: dst})
 		}
 		//log.Printf("dir=%v dst=%s, path=%s\n", d.IsDir(), dst, path)
 		if d.IsDir() {
@@ -484,6 +866,7 @@ func (i *Image) Import(filename string) error {
 			if err != nil {
 				return Fatal(err)
 			}
+			dirs[path] = dst
 		} else {
 			err := i.AddFile(dst, path)
 			if err != nil {
@@ -493,21 +876,58 @@ func (i *Image) Import(filename string) error {
 		return nil
 	})
 	if err != nil {
-		return Fatal(err)
+		return renamed, Fatal(err)
+	}
+	return renamed, nil
+}
+
+// legalNames returns the lower-cased names in a host directory that are
+// legal FAT names and are imported as they are.
+func legalNames(dir string) (map[string]bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, entry := range entries {
+		if fat.ValidateName(entry.Name()) == nil {
+			names[strings.ToLower(entry.Name())] = true
+		}
+	}
+	return names, nil
+}
+
+// sanitizedPath returns the image path for a host name that is not a
+// legal FAT name, numbering it if the sanitized name is already taken,
+// in the image or by one of the legal host names.
+func (i *Image) sanitizedPath(dir, name string, legal map[string]bool) (string, error) {
+	name = fat.SanitizeName(name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		candidate := name
+		if n > 1 {
+			candidate = fmt.Sprintf("%s_%d%s", base, n, ext)
+		}
+		if legal[strings.ToLower(candidate)] {
+			continue
+		}
+		dst := filepath.ToSlash(filepath.Join(dir, candidate))
+		_, err := i.fs.Stat(dst)
+		if errors.Is(err, fat.ErrNotExist) {
+			return dst, nil
+		}
+		if err != nil {
+			return "", Fatal(err)
+		}
 	}
-	return nil
 }
 
 func (i *Image) SetAttr(filename string, attr ffs.DirectoryAttr, state bool) error {
-	path, file := filepath.Split(filename)
-	dir, err := i.getDir(path)
+	entry, err := i.fs.Lookup(filename)
 	if err != nil {
 		return Fatal(err)
 	}
-	entry := dir.Entry(file)
-	if entry == nil {
-		return Fatalf("not found: %s", filename)
-	}
 	err = entry.SetAttr(attr, state)
 	if err != nil {
 		return Fatal(err)
@@ -516,15 +936,10 @@ func (i *Image) SetAttr(filename string, attr ffs.DirectoryAttr, state bool) err
 }
 
 func (i *Image) GetAttr(filename string) (ffs.DirectoryAttr, error) {
-	path, file := filepath.Split(filename)
-	dir, err := i.getDir(path)
+	entry, err := i.fs.Lookup(filename)
 	if err != nil {
 		return 0, Fatal(err)
 	}
-	entry := dir.Entry(file)
-	if entry == nil {
-		return 0, Fatalf("not found: %s", filename)
-	}
 	return entry.Attr(), nil
 }
 
@@ -536,6 +951,81 @@ func (i *Image) VolumeLabel() (string, error) {
 	return vid, nil
 }
 
+func (i *Image) SetVolumeLabel(label string) error {
+	err := i.fs.SetVolumeLabel(label)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+func (i *Image) SetOEMName(name string) error {
+	err := i.fs.SetOEMName(name)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+func (i *Image) VolumeID() (uint32, error) {
+	id, err := i.fs.VolumeID()
+	if err != nil {
+		return 0, Fatal(err)
+	}
+	return id, nil
+}
+
+func (i *Image) SetVolumeID(id uint32) error {
+	err := i.fs.SetVolumeID(id)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+func (i *Image) BootCode() (*fat.BootCode, error) {
+	code, err := i.fs.BootCode()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return code, nil
+}
+
+func (i *Image) SetBootCode(code *fat.BootCode) error {
+	err := i.fs.SetBootCode(code)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
+// copyBootCode copies the boot code of the src image to the dst image.
+// FAT32 boot code starts at another offset and expects another BIOS
+// parameter block, so it is only copied between images that are both
+// FAT32 or both FAT12/16.
+func copyBootCode(dst, src *Image) error {
+	srcType, err := src.FATType()
+	if err != nil {
+		return Fatal(err)
+	}
+	dstType, err := dst.FATType()
+	if err != nil {
+		return Fatal(err)
+	}
+	if (srcType == 32) != (dstType == 32) {
+		return nil
+	}
+	code, err := src.BootCode()
+	if err != nil {
+		return Fatal(err)
+	}
+	err = dst.SetBootCode(code)
+	if err != nil {
+		return Fatal(err)
+	}
+	return nil
+}
+
 func (i *Image) OEMName() (string, error) {
 	oem, err := i.fs.OEMName()
 	if err != nil {
@@ -1,8 +1,12 @@
 package image
 
 import (
+	"bytes"
 	"github.com/rstms/ffs"
+	"github.com/rstms/ffs/fat"
+	"github.com/rstms/ffs/mbr"
 	"github.com/stretchr/testify/require"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
@@ -306,3 +310,393 @@ func TestImageReadFile(t *testing.T) {
 
 	log.Printf("%s\n", string(data))
 }
+
+func TestImageErrors(t *testing.T) {
+	imgFile := filepath.Join(t.TempDir(), "errors.img")
+	i, err := CreateImage(imgFile, "errors", "ffs", 12, 1440*1024)
+	require.Nil(t, err)
+	defer i.Close()
+
+	_, err = i.ReadFile("/missing")
+	require.ErrorIs(t, err, fat.ErrNotExist)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	var pathErr *fat.PathError
+	require.ErrorAs(t, err, &pathErr)
+	require.Equal(t, "/missing", pathErr.Path)
+
+	require.Nil(t, i.Mkdir("/dir"))
+	err = i.Mkdir("/dir")
+	require.ErrorIs(t, err, fs.ErrExist)
+
+	_, err = i.GetAttr("/nodir/file")
+	require.ErrorIs(t, err, fat.ErrNotExist)
+}
+
+func TestImageReadOnly(t *testing.T) {
+	imgFile := filepath.Join(t.TempDir(), "readonly.img")
+	i, err := CreateImage(imgFile, "readonly", "ffs", 12, 1440*1024)
+	require.Nil(t, err)
+	srcFile := filepath.Join(t.TempDir(), "hello")
+	require.Nil(t, os.WriteFile(srcFile, []byte("hello"), 0600))
+	require.Nil(t, i.AddFile("hello", srcFile))
+	require.Nil(t, i.Close())
+
+	before, err := os.ReadFile(imgFile)
+	require.Nil(t, err)
+
+	// The file is writable, the device and filesystem refuse writes
+	i, err = OpenImageReadOnly(imgFile)
+	require.Nil(t, err)
+	require.True(t, i.disk.ReadOnly())
+	require.True(t, i.fs.ReadOnly())
+	_, err = i.disk.WriteAt([]byte{0}, 0)
+	require.ErrorIs(t, err, ffs.ErrReadOnly)
+
+	data, err := i.ReadFile("hello")
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(data))
+
+	err = i.AddFile("other", srcFile)
+	require.ErrorIs(t, err, fat.ErrReadOnly)
+	require.ErrorIs(t, err, ffs.ErrReadOnly)
+	require.ErrorIs(t, i.Mkdir("dir"), fs.ErrPermission)
+	require.ErrorIs(t, i.SetAttr("hello", ffs.AttrHidden, true), fat.ErrReadOnly)
+	require.Nil(t, i.Close())
+
+	after, err := os.ReadFile(imgFile)
+	require.Nil(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestImageImportSanitize(t *testing.T) {
+	srcDir := t.TempDir()
+	require.Nil(t, os.Mkdir(filepath.Join(srcDir, "what?"), 0700))
+	for _, name := range []string{"what?/a:b.txt", "what?/a*b.txt", "CON.txt", "ok.txt"} {
+		require.Nil(t, os.WriteFile(filepath.Join(srcDir, name), []byte(name), 0600))
+	}
+
+	imgFile := filepath.Join(t.TempDir(), "sanitize.img")
+	i, err := CreateImage(imgFile, "sanitize", "ffs", 12, 1440*1024)
+	require.Nil(t, err)
+	defer i.Close()
+
+	err = i.Import(srcDir)
+	require.ErrorIs(t, err, fat.ErrInvalidName)
+
+	j, err := CreateImage(filepath.Join(t.TempDir(), "sanitized.img"), "sanitize", "ffs", 12, 1440*1024)
+	require.Nil(t, err)
+	defer j.Close()
+
+	renamed, err := j.ImportWithOptions(srcDir, ImportOptions{Sanitize: true})
+	require.Nil(t, err)
+	require.ElementsMatch(t, []RenamedFile{
+		{Source: filepath.Join(srcDir, "CON.txt"), Name: "CON_.txt"},
+		{Source: filepath.Join(srcDir, "what?"), Name: "what_"},
+		{Source: filepath.Join(srcDir, "what?", "a*b.txt"), Name: "what_/a_b.txt"},
+		{Source: filepath.Join(srcDir, "what?", "a:b.txt"), Name: "what_/a_b_2.txt"},
+	}, renamed)
+
+	data, err := j.ReadFile("what_/a_b_2.txt")
+	require.Nil(t, err)
+	require.Equal(t, "what?/a:b.txt", string(data))
+	data, err = j.ReadFile("ok.txt")
+	require.Nil(t, err)
+	require.Equal(t, "ok.txt", string(data))
+}
+
+func TestImageImportSanitizeCollision(t *testing.T) {
+	// a*b.txt is walked first and sanitizes to the name of a_b.txt
+	srcDir := t.TempDir()
+	for _, name := range []string{"a*b.txt", "a_b.txt"} {
+		require.Nil(t, os.WriteFile(filepath.Join(srcDir, name), []byte(name), 0600))
+	}
+
+	i, err := CreateImage(filepath.Join(t.TempDir(), "collision.img"), "sanitize", "ffs", 12, 1440*1024)
+	require.Nil(t, err)
+	defer i.Close()
+
+	renamed, err := i.ImportWithOptions(srcDir, ImportOptions{Sanitize: true})
+	require.Nil(t, err)
+	require.Equal(t, []RenamedFile{
+		{Source: filepath.Join(srcDir, "a*b.txt"), Name: "a_b_2.txt"},
+	}, renamed)
+
+	data, err := i.ReadFile("a_b.txt")
+	require.Nil(t, err)
+	require.Equal(t, "a_b.txt", string(data))
+	data, err = i.ReadFile("a_b_2.txt")
+	require.Nil(t, err)
+	require.Equal(t, "a*b.txt", string(data))
+}
+
+func TestImageCreateFloppy(t *testing.T) {
+	imgFile := filepath.Join(t.TempDir(), "floppy.img")
+	i, err := CreateImageWithConfig(imgFile, 0, &fat.SuperFloppyConfig{
+		FATType: fat.FAT12,
+		Label:   "floppy",
+		OEMName: "ffs",
+		Floppy:  "720K",
+	})
+	require.Nil(t, err)
+	defer i.Close()
+
+	info, err := os.Stat(imgFile)
+	require.Nil(t, err)
+	require.Equal(t, int64(720*1024), info.Size())
+
+	_, err = CreateImageWithConfig(filepath.Join(t.TempDir(), "bad.img"), 0, &fat.SuperFloppyConfig{
+		FATType: fat.FAT12,
+		Floppy:  "bogus",
+	})
+	require.NotNil(t, err)
+
+	// CreateImage picks the floppy format from the size
+	sizedFile := filepath.Join(t.TempDir(), "sized.img")
+	j, err := CreateImage(sizedFile, "floppy", "ffs", 12, 720*1024)
+	require.Nil(t, err)
+	require.Nil(t, j.Close())
+	for _, filename := range []string{imgFile, sizedFile} {
+		data, err := os.ReadFile(filename)
+		require.Nil(t, err)
+		require.Equal(t, byte(0xF9), data[21], "media descriptor of %s", filename)
+	}
+}
+
+func TestImageMungeBootCode(t *testing.T) {
+	srcFile := filepath.Join(t.TempDir(), "boot.img")
+	bootCode := &fat.BootCode{Code: []byte{0xFA, 0xF4}}
+	i, err := CreateImageWithConfig(srcFile, 0, &fat.SuperFloppyConfig{
+		FATType:  fat.FAT12,
+		Label:    "boot",
+		OEMName:  "ffs",
+		Floppy:   "1.44M",
+		BootCode: bootCode,
+	})
+	require.Nil(t, err)
+	require.Nil(t, i.Close())
+
+	dstFile := filepath.Join(t.TempDir(), "munged.img")
+	err = MungeImage(dstFile, srcFile, "", nil)
+	require.Nil(t, err)
+
+	j, err := OpenImageReadOnly(dstFile)
+	require.Nil(t, err)
+	defer j.Close()
+	code, err := j.BootCode()
+	require.Nil(t, err)
+	require.Equal(t, []byte{0xFA, 0xF4}, code.Code[:2])
+	require.Equal(t, [3]byte{0xEB, 0x3C, 0x90}, code.Jump)
+}
+
+func TestImageFileExtentsHiddenSectors(t *testing.T) {
+	srcDir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(srcDir, "ldlinux.sys"), []byte("loader"), 0600))
+
+	// A super floppy with hidden sectors in its boot sector, as if it
+	// had been copied off a partition
+	imgFile := filepath.Join(t.TempDir(), "hidden.img")
+	i, err := CreateImageWithConfig(imgFile, 0, &fat.SuperFloppyConfig{
+		FATType:       fat.FAT12,
+		Floppy:        "1.44M",
+		HiddenSectors: 63,
+	})
+	require.Nil(t, err)
+	require.Nil(t, i.Import(srcDir))
+	extents, err := i.FileExtents("ldlinux.sys")
+	require.Nil(t, err)
+	require.Len(t, extents, 1)
+	require.Equal(t, extents[0].Offset, extents[0].DiskOffset)
+	require.Nil(t, i.Close())
+
+	raw, err := os.ReadFile(imgFile)
+	require.Nil(t, err)
+	require.Equal(t, "loader", string(raw[extents[0].DiskOffset:][:6]))
+}
+
+func TestImagePartitioned(t *testing.T) {
+	srcDir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(srcDir, "ldlinux.sys"), []byte("loader"), 0600))
+
+	srcFile := filepath.Join(t.TempDir(), "disk.img")
+	bootstrap := []byte{0xFA, 0x33, 0xC0, 0x8E, 0xD0}
+	i, err := CreatePartitionedImage(srcFile, 32*MB, &PartitionConfig{
+		Active:        true,
+		Bootstrap:     bootstrap,
+		DiskSignature: 0x12345678,
+	}, &fat.SuperFloppyConfig{
+		FATType:  fat.FAT16,
+		Label:    "boot",
+		OEMName:  "ffs",
+		BootCode: &fat.BootCode{Code: []byte{0xF4}},
+	})
+	require.Nil(t, err)
+	require.Nil(t, i.Import(srcDir))
+	extents, err := i.FileExtents("ldlinux.sys")
+	require.Nil(t, err)
+	require.Len(t, extents, 1)
+	require.Equal(t, extents[0].Offset+2048*512, extents[0].DiskOffset)
+	require.Nil(t, i.Close())
+
+	// The disk offset is where the file is in the image file
+	raw, err := os.ReadFile(srcFile)
+	require.Nil(t, err)
+	require.Equal(t, "loader", string(raw[extents[0].DiskOffset:][:6]))
+
+	i, err = OpenImage(srcFile)
+	require.Nil(t, err)
+	table := i.MBR()
+	require.NotNil(t, table)
+	require.Equal(t, uint32(2048), table.Partitions[0].Start)
+	require.Equal(t, uint8(mbr.TypeFAT16), table.Partitions[0].Type)
+	require.Equal(t, 0, table.Active())
+	require.Nil(t, i.SetActivePartition(-1))
+	require.Equal(t, -1, i.MBR().Active())
+	require.Nil(t, i.SetActivePartition(0))
+	require.Nil(t, i.Close())
+	require.ErrorIs(t, i.SetDiskSignature(1), fat.ErrClosed)
+	require.ErrorIs(t, i.SetMBRBootstrap(bootstrap), fat.ErrClosed)
+	require.ErrorIs(t, i.SetActivePartition(0), fat.ErrClosed)
+
+	check := func(filename string) {
+		j, err := OpenImageReadOnly(filename)
+		require.Nil(t, err)
+		defer j.Close()
+		table := j.MBR()
+		require.NotNil(t, table)
+		require.Equal(t, bootstrap, table.Bootstrap[:len(bootstrap)])
+		require.Equal(t, uint32(0x12345678), table.DiskSignature)
+		require.Equal(t, 0, table.Active())
+		require.Equal(t, uint32(2048), table.Partitions[0].Start)
+		code, err := j.BootCode()
+		require.Nil(t, err)
+		require.Equal(t, byte(0xF4), code.Code[0])
+		data, err := j.ReadFile("ldlinux.sys")
+		require.Nil(t, err)
+		require.Equal(t, "loader", string(data))
+		require.ErrorIs(t, j.SetDiskSignature(1), fat.ErrReadOnly)
+		require.ErrorIs(t, j.SetMBRBootstrap(bootstrap), fat.ErrReadOnly)
+		require.ErrorIs(t, j.SetActivePartition(0), fat.ErrReadOnly)
+	}
+
+	mungedFile := filepath.Join(t.TempDir(), "munged.img")
+	require.Nil(t, MungeImage(mungedFile, srcFile, "", nil))
+	check(mungedFile)
+
+	rewrittenFile := filepath.Join(t.TempDir(), "rewritten.img")
+	require.Nil(t, RewriteImage(rewrittenFile, srcFile, 16, 48*MB))
+	check(rewrittenFile)
+
+	// A super floppy has no master boot record
+	floppyFile := filepath.Join(t.TempDir(), "floppy.img")
+	f, err := CreateImage(floppyFile, "floppy", "ffs", 12, 1440*1024)
+	require.Nil(t, err)
+	defer f.Close()
+	require.Nil(t, f.MBR())
+	require.ErrorIs(t, f.SetActivePartition(0), mbr.ErrNoMBR)
+}
+
+func TestImagePinFile(t *testing.T) {
+	srcDir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(srcDir, "filler.txt"), make([]byte, 3000), 0600))
+	require.Nil(t, os.Mkdir(filepath.Join(srcDir, "syslinux"), 0700))
+	loader := bytes.Repeat([]byte("ldlinux"), 300)
+	require.Nil(t, os.WriteFile(filepath.Join(srcDir, "syslinux", "ldlinux.sys"), loader, 0600))
+
+	srcFile := filepath.Join(t.TempDir(), "boot.img")
+	i, err := CreateImage(srcFile, "boot", "ffs", 12, 1440*1024)
+	require.Nil(t, err)
+	require.Nil(t, i.Import(srcDir))
+	sectors, err := i.PinFile("syslinux/ldlinux.sys")
+	require.Nil(t, err)
+	require.Len(t, sectors, 5)
+	// Remove the filler so the copy would otherwise put the loader first
+	require.Nil(t, i.fs.Remove("filler.txt"))
+	require.Nil(t, i.Close())
+
+	check := func(filename string) {
+		j, err := OpenImageReadOnly(filename)
+		require.Nil(t, err)
+		defer j.Close()
+		pinned, err := j.FileSectors("syslinux/ldlinux.sys")
+		require.Nil(t, err)
+		require.Equal(t, sectors, pinned)
+		attr, err := j.GetAttr("syslinux/ldlinux.sys")
+		require.Nil(t, err)
+		require.Equal(t, fat.PinAttr, attr&fat.PinAttr)
+		data, err := j.ReadFile("syslinux/ldlinux.sys")
+		require.Nil(t, err)
+		require.Equal(t, loader, data)
+	}
+
+	mungedFile := filepath.Join(t.TempDir(), "munged.img")
+	require.Nil(t, MungeImage(mungedFile, srcFile, "", nil))
+	check(mungedFile)
+
+	rewrittenFile := filepath.Join(t.TempDir(), "rewritten.img")
+	require.Nil(t, RewriteImage(rewrittenFile, srcFile, 12, 1440*1024))
+	check(rewrittenFile)
+}
+
+func TestImageDirty(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dirty.img")
+	i, err := CreateImage(filename, "dirty", "ffs", 16, 16*MB)
+	require.Nil(t, err)
+
+	j, err := OpenImageReadOnly(filename)
+	require.Nil(t, err)
+	info, err := j.Info()
+	require.Nil(t, err)
+	require.Equal(t, true, info["Dirty"])
+	require.Nil(t, j.Close())
+
+	require.Nil(t, i.Close())
+	j, err = OpenImageReadOnly(filename)
+	require.Nil(t, err)
+	defer j.Close()
+	info, err = j.Info()
+	require.Nil(t, err)
+	require.Equal(t, false, info["Dirty"])
+}
+
+func TestImageCodePage(t *testing.T) {
+	srcDir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(srcDir, "отчёт.txt"), []byte("data"), 0600))
+
+	srcFile := filepath.Join(t.TempDir(), "cp866.img")
+	i, err := CreateImageWithConfig(srcFile, 0, &fat.SuperFloppyConfig{
+		FATType:  fat.FAT12,
+		Label:    "ДИСК",
+		Floppy:   "1.44M",
+		CodePage: fat.CP866,
+	})
+	require.Nil(t, err)
+	require.Nil(t, i.Import(srcDir))
+	require.Nil(t, i.Close())
+
+	check := func(filename string) {
+		j, err := OpenImageWithConfig(filename, &fat.Config{ReadOnly: true, CodePage: fat.CP866})
+		require.Nil(t, err)
+		defer j.Close()
+		label, err := j.VolumeLabel()
+		require.Nil(t, err)
+		require.Equal(t, "ДИСК", label)
+		records, err := j.ScanFiles()
+		require.Nil(t, err)
+		require.Len(t, records, 1)
+		require.Equal(t, "ОТЧЁТ.TXT", records[0].ShortName)
+	}
+	check(srcFile)
+
+	mungedFile := filepath.Join(t.TempDir(), "munged.img")
+	require.Nil(t, MungeImageWithCodePage(mungedFile, srcFile, "", nil, fat.CP866))
+	check(mungedFile)
+
+	// The default CP437 decodes the same bytes differently
+	j, err := OpenImageReadOnly(srcFile)
+	require.Nil(t, err)
+	defer j.Close()
+	label, err := j.VolumeLabel()
+	require.Nil(t, err)
+	require.NotEqual(t, "ДИСК", label)
+}
@@ -3,15 +3,13 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 */
 package image
 
-import (
-	"github.com/rstms/ffs"
-	"os"
-	"os/exec"
-	"path/filepath"
-)
-
+// RewriteImage writes the files of the srcFile image to a new dstFile
+// image of the given FAT type and size. A partitioned image keeps its
+// partition offset and master boot record. The boot code is kept unless
+// it is rewritten between FAT32 and FAT12/16, and pinned files keep
+// their sectors.
 func RewriteImage(dstFile, srcFile string, fatType int, size int64) error {
-	src, err := OpenImage(srcFile)
+	src, err := OpenImageReadOnly(srcFile)
 	if err != nil {
 		return Fatal(err)
 	}
@@ -30,57 +28,18 @@ func RewriteImage(dstFile, srcFile string, fatType int, size int64) error {
 	if err != nil {
 		return Fatal(err)
 	}
-	tempDir, err := os.MkdirTemp("", "mkimage-*")
+	dst, err := createImageLike(dstFile, src, volume, oem, fatType, size)
 	if err != nil {
 		return Fatal(err)
 	}
-	defer os.RemoveAll(tempDir)
-	for _, record := range records {
-		if record.Dir {
-			err := os.Mkdir(filepath.Join(tempDir, record.Name), 0700)
-			if err != nil {
-				return Fatal(err)
-			}
-		} else {
-			dstFile := filepath.Join(tempDir, record.Name)
-			output, err := exec.Command("mtype", "-i", srcFile, "::"+record.Name).Output()
-			if err != nil {
-				return Fatal(err)
-			}
-			err = os.WriteFile(dstFile, output, 0600)
-			if err != nil {
-				return Fatal(err)
-			}
-		}
-	}
-	dst, err := CreateImage(dstFile, volume, oem, fatType, size)
+	defer dst.Close()
+	err = copyBootCode(dst, src)
 	if err != nil {
 		return Fatal(err)
 	}
-	defer dst.Close()
-	err = dst.Import(tempDir)
+	err = copyFiles(dst, src, records)
 	if err != nil {
 		return Fatal(err)
 	}
-	for _, record := range records {
-		if record.System {
-			err := dst.SetAttr(record.Name, ffs.AttrSystem, true)
-			if err != nil {
-				return Fatal(err)
-			}
-		}
-		if record.Hidden {
-			err := dst.SetAttr(record.Name, ffs.AttrHidden, true)
-			if err != nil {
-				return Fatal(err)
-			}
-		}
-		if record.ReadOnly {
-			err := dst.SetAttr(record.Name, ffs.AttrReadOnly, true)
-			if err != nil {
-				return Fatal(err)
-			}
-		}
-	}
 	return nil
 }
@@ -0,0 +1,24 @@
+// Package fatal keeps the error chain of the errors returned by the
+// go-common Fatal proxies of this module.
+package fatal
+
+// wrapped carries the message annotated by go-common while keeping the
+// original error available to errors.Is and errors.As.
+type wrapped struct {
+	msg string
+	err error
+}
+
+func (e *wrapped) Error() string {
+	return e.msg
+}
+
+func (e *wrapped) Unwrap() error {
+	return e.err
+}
+
+// Wrap returns an error with the message of annotated that unwraps to
+// err.
+func Wrap(annotated, err error) error {
+	return &wrapped{msg: annotated.Error(), err: err}
+}
@@ -0,0 +1,48 @@
+// Package testdisk provides the in-memory block device used by the
+// tests of this module.
+package testdisk
+
+import (
+	"io"
+)
+
+// MemDisk is a block device backed by a byte slice that counts the
+// calls made to it.
+type MemDisk struct {
+	Data   []byte
+	Reads  int
+	Writes int
+}
+
+// New returns a MemDisk holding data.
+func New(data []byte) *MemDisk {
+	return &MemDisk{Data: data}
+}
+
+func (m *MemDisk) Close() error    { return nil }
+func (m *MemDisk) Len() int64      { return int64(len(m.Data)) }
+func (m *MemDisk) SectorSize() int { return 512 }
+
+func (m *MemDisk) ReadAt(p []byte, off int64) (int, error) {
+	m.Reads++
+	if off < 0 || off >= int64(len(m.Data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.Data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MemDisk) WriteAt(p []byte, off int64) (int, error) {
+	m.Writes++
+	if off < 0 || off >= int64(len(m.Data)) {
+		return 0, io.ErrShortWrite
+	}
+	n := copy(m.Data[off:], p)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
@@ -0,0 +1,23 @@
+// go-common local proxy functions
+
+package mbr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rstms/ffs/internal/fatal"
+	"github.com/rstms/go-common"
+)
+
+func Fatal(err error) error {
+	return fatal.Wrap(common.Fatal(err), err)
+}
+
+func Fatalf(format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if errors.Unwrap(err) == nil {
+		return common.Fatalf(format, args...)
+	}
+	return fatal.Wrap(common.Fatal(err), err)
+}
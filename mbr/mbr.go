@@ -0,0 +1,222 @@
+// Package mbr reads and writes the master boot record of a partitioned
+// disk: the BIOS bootstrap code, the disk signature and the primary
+// partition table.
+package mbr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+
+	"github.com/rstms/ffs"
+)
+
+const (
+	// BootstrapSize is the size of the boot code in front of the disk
+	// signature.
+	BootstrapSize = 440
+
+	// PartitionCount is the number of primary partitions.
+	PartitionCount = 4
+)
+
+// Partition types of FAT filesystems.
+const (
+	TypeEmpty      = 0x00
+	TypeFAT12      = 0x01
+	TypeFAT16Small = 0x04
+	TypeFAT16      = 0x06
+	TypeFAT32      = 0x0B
+	TypeFAT32LBA   = 0x0C
+	TypeFAT16LBA   = 0x0E
+)
+
+// ErrNoMBR is returned when the first sector of a device is not a
+// master boot record.
+var ErrNoMBR = fmt.Errorf("no master boot record: %w", fs.ErrInvalid)
+
+const (
+	diskSignatureOffset  = 440
+	partitionTableOffset = 446
+	partitionEntrySize   = 16
+	statusActive         = 0x80
+)
+
+// Partition is an entry in the partition table. Start and Sectors are
+// in sectors; the CHS addresses are derived from them when writing.
+type Partition struct {
+	Active  bool
+	Type    uint8
+	Start   uint32
+	Sectors uint32
+}
+
+// Empty returns true if the entry holds no partition.
+func (p *Partition) Empty() bool {
+	return p.Type == TypeEmpty || p.Sectors == 0
+}
+
+// MBR is the master boot record in the first sector of a disk.
+type MBR struct {
+	Bootstrap     [BootstrapSize]byte
+	DiskSignature uint32
+	Partitions    [PartitionCount]Partition
+}
+
+// Decode reads the master boot record of the device. It returns ErrNoMBR
+// if the first sector doesn't hold a valid partition table.
+func Decode(device ffs.BlockDevice) (*MBR, error) {
+	var sector [512]byte
+	if _, err := device.ReadAt(sector[:], 0); err != nil {
+		return nil, Fatal(err)
+	}
+
+	if sector[510] != 0x55 || sector[511] != 0xAA {
+		return nil, Fatalf("missing boot signature: %w", ErrNoMBR)
+	}
+
+	result := new(MBR)
+	copy(result.Bootstrap[:], sector[:BootstrapSize])
+	result.DiskSignature = binary.LittleEndian.Uint32(sector[diskSignatureOffset : diskSignatureOffset+4])
+
+	sectors := device.Len() / int64(device.SectorSize())
+	found := false
+	for i := range result.Partitions {
+		entry := sector[partitionTableOffset+i*partitionEntrySize:][:partitionEntrySize]
+		if entry[0] != 0 && entry[0] != statusActive {
+			return nil, Fatalf("partition %d has status %#02x: %w", i, entry[0], ErrNoMBR)
+		}
+
+		p := &result.Partitions[i]
+		p.Active = entry[0] == statusActive
+		p.Type = entry[4]
+		p.Start = binary.LittleEndian.Uint32(entry[8:12])
+		p.Sectors = binary.LittleEndian.Uint32(entry[12:16])
+		if p.Empty() {
+			continue
+		}
+
+		if p.Start == 0 || int64(p.Start)+int64(p.Sectors) > sectors {
+			return nil, Fatalf("partition %d outside the disk: %w", i, ErrNoMBR)
+		}
+		found = true
+	}
+
+	if !found {
+		return nil, Fatalf("empty partition table: %w", ErrNoMBR)
+	}
+
+	return result, nil
+}
+
+// Bytes returns the master boot record as a sector.
+func (m *MBR) Bytes() []byte {
+	sector := make([]byte, 512)
+	copy(sector, m.Bootstrap[:])
+	binary.LittleEndian.PutUint32(sector[diskSignatureOffset:diskSignatureOffset+4], m.DiskSignature)
+
+	for i, p := range m.Partitions {
+		if p.Empty() {
+			continue
+		}
+
+		entry := sector[partitionTableOffset+i*partitionEntrySize:][:partitionEntrySize]
+		if p.Active {
+			entry[0] = statusActive
+		}
+		putCHS(entry[1:4], p.Start)
+		entry[4] = p.Type
+		putCHS(entry[5:8], p.Start+p.Sectors-1)
+		binary.LittleEndian.PutUint32(entry[8:12], p.Start)
+		binary.LittleEndian.PutUint32(entry[12:16], p.Sectors)
+	}
+
+	sector[510] = 0x55
+	sector[511] = 0xAA
+	return sector
+}
+
+// Write writes the master boot record to the first sector of the device.
+func (m *MBR) Write(device ffs.BlockDevice) error {
+	if _, err := device.WriteAt(m.Bytes(), 0); err != nil {
+		return Fatal(err)
+	}
+
+	return nil
+}
+
+// SetBootstrap installs the boot code, zeroing the rest of the
+// bootstrap area.
+func (m *MBR) SetBootstrap(code []byte) error {
+	if len(code) > BootstrapSize {
+		return Fatalf("bootstrap of %d bytes larger than %d", len(code), BootstrapSize)
+	}
+
+	m.Bootstrap = [BootstrapSize]byte{}
+	copy(m.Bootstrap[:], code)
+	return nil
+}
+
+// Active returns the index of the active partition, or -1 if there is
+// none.
+func (m *MBR) Active() int {
+	for i, p := range m.Partitions {
+		if p.Active && !p.Empty() {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// SetActive marks partition n as the one the BIOS boots from, clearing
+// the flag on the others. An n of -1 leaves no partition active.
+func (m *MBR) SetActive(n int) error {
+	if n < -1 || n >= PartitionCount {
+		return Fatalf("no partition %d", n)
+	}
+
+	if n >= 0 && m.Partitions[n].Empty() {
+		return Fatalf("partition %d is empty", n)
+	}
+
+	for i := range m.Partitions {
+		m.Partitions[i].Active = i == n
+	}
+
+	return nil
+}
+
+// Device returns a block device for partition n of the device.
+func (m *MBR) Device(device ffs.BlockDevice, n int) (*ffs.PartitionDisk, error) {
+	if n < 0 || n >= PartitionCount || m.Partitions[n].Empty() {
+		return nil, Fatalf("no partition %d: %w", n, fs.ErrNotExist)
+	}
+
+	p := m.Partitions[n]
+	sectorSize := int64(device.SectorSize())
+	result, err := ffs.NewPartitionDisk(device, int64(p.Start)*sectorSize, int64(p.Sectors)*sectorSize)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+
+	return result, nil
+}
+
+// putCHS writes the cylinder-head-sector address of a sector for the
+// usual translated geometry of 255 heads and 63 sectors per track.
+// Sectors beyond the reach of CHS get the largest address.
+func putCHS(data []byte, lba uint32) {
+	const heads, sectors = 255, 63
+
+	cylinder := lba / (heads * sectors)
+	head := (lba / sectors) % heads
+	sector := lba%sectors + 1
+	if cylinder > 1023 {
+		cylinder, head, sector = 1023, 254, 63
+	}
+
+	data[0] = byte(head)
+	data[1] = byte(sector) | byte(cylinder>>2)&0xC0
+	data[2] = byte(cylinder)
+}
@@ -0,0 +1,84 @@
+package mbr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rstms/ffs/internal/testdisk"
+)
+
+func TestMBR_RoundTrip(t *testing.T) {
+	disk := testdisk.New(make([]byte, 64*1024*1024))
+
+	if _, err := Decode(disk); !errors.Is(err, ErrNoMBR) {
+		t.Fatalf("expected ErrNoMBR, got %v", err)
+	}
+
+	m := &MBR{DiskSignature: 0xDEADBEEF}
+	m.Partitions[0] = Partition{Type: TypeFAT16, Start: 2048, Sectors: 8192}
+	m.Partitions[1] = Partition{Type: TypeFAT12, Start: 10240, Sectors: 2048}
+	if err := m.SetBootstrap([]byte{0xFA, 0x33, 0xC0}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m.SetActive(1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := m.Write(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	decoded, err := Decode(disk)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if *decoded != *m {
+		t.Fatalf("expected %+v, got %+v", m, decoded)
+	}
+	if decoded.Active() != 1 {
+		t.Fatalf("bad active partition %d", decoded.Active())
+	}
+
+	// CHS of LBA 2048 is 0/32/33
+	sector := m.Bytes()
+	if sector[446] != 0 || sector[447] != 32 || sector[448] != 33 || sector[449] != 0 {
+		t.Fatalf("bad CHS: % x", sector[446:450])
+	}
+	if sector[462] != 0x80 {
+		t.Fatal("partition 1 not active")
+	}
+
+	part, err := decoded.Device(disk, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if part.Offset() != 10240*512 || part.Len() != 2048*512 {
+		t.Fatalf("bad partition device: %d at %d", part.Len(), part.Offset())
+	}
+}
+
+func TestMBR_Errors(t *testing.T) {
+	m := &MBR{}
+	m.Partitions[0] = Partition{Type: TypeFAT16, Start: 2048, Sectors: 8192}
+
+	if err := m.SetBootstrap(make([]byte, BootstrapSize+1)); err == nil {
+		t.Fatal("expected error for bootstrap too long")
+	}
+	if err := m.SetActive(2); err == nil {
+		t.Fatal("expected error for empty partition")
+	}
+	if err := m.SetActive(-1); err != nil || m.Active() != -1 {
+		t.Fatalf("expected no active partition: %v", err)
+	}
+	if _, err := m.Device(testdisk.New(make([]byte, 1024*1024)), 3); err == nil {
+		t.Fatal("expected error for empty partition")
+	}
+
+	// A partition beyond the end of the disk
+	disk := testdisk.New(make([]byte, 1024*1024))
+	if err := m.Write(disk); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := Decode(disk); !errors.Is(err, ErrNoMBR) {
+		t.Fatalf("expected ErrNoMBR, got %v", err)
+	}
+}
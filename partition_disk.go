@@ -0,0 +1,84 @@
+package ffs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A PartitionDisk is a BlockDevice that is a range of sectors of another
+// BlockDevice, such as a partition of a disk. Closing it does not close
+// the underlying device.
+type PartitionDisk struct {
+	device BlockDevice
+	offset int64
+	size   int64
+}
+
+var _ ReadOnlyDevice = (*PartitionDisk)(nil)
+
+// NewPartitionDisk creates a PartitionDisk of size bytes starting at
+// offset bytes into device. Both must be multiples of the sector size.
+func NewPartitionDisk(device BlockDevice, offset, size int64) (*PartitionDisk, error) {
+	sectorSize := int64(device.SectorSize())
+	if offset%sectorSize != 0 || size%sectorSize != 0 {
+		return nil, fmt.Errorf("partition at %d of %d bytes not sector aligned", offset, size)
+	}
+
+	if offset < 0 || size <= 0 || offset+size > device.Len() {
+		return nil, fmt.Errorf("partition at %d of %d bytes outside device of %d bytes", offset, size, device.Len())
+	}
+
+	return &PartitionDisk{
+		device: device,
+		offset: offset,
+		size:   size,
+	}, nil
+}
+
+func (p *PartitionDisk) Close() error {
+	return nil
+}
+
+func (p *PartitionDisk) Len() int64 {
+	return p.size
+}
+
+// Offset returns the offset in bytes of the partition on the underlying
+// device.
+func (p *PartitionDisk) Offset() int64 {
+	return p.offset
+}
+
+func (p *PartitionDisk) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off >= p.size {
+		return 0, io.EOF
+	}
+
+	if remaining := p.size - off; int64(len(b)) > remaining {
+		n, err := p.device.ReadAt(b[:remaining], p.offset+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+
+	return p.device.ReadAt(b, p.offset+off)
+}
+
+func (p *PartitionDisk) ReadOnly() bool {
+	ro, ok := p.device.(ReadOnlyDevice)
+	return ok && ro.ReadOnly()
+}
+
+func (p *PartitionDisk) SectorSize() int {
+	return p.device.SectorSize()
+}
+
+func (p *PartitionDisk) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > p.size {
+		return 0, errors.New("write beyond the end of the partition")
+	}
+
+	return p.device.WriteAt(b, p.offset+off)
+}
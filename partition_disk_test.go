@@ -0,0 +1,56 @@
+package ffs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/rstms/ffs/internal/testdisk"
+)
+
+func TestPartitionDiskImplementsBlockDevice(t *testing.T) {
+	var raw interface{}
+	raw = new(PartitionDisk)
+	if _, ok := raw.(BlockDevice); !ok {
+		t.Fatal("PartitionDisk should be a BlockDevice")
+	}
+}
+
+func TestPartitionDisk(t *testing.T) {
+	disk := testdisk.New(make([]byte, 8*512))
+
+	if _, err := NewPartitionDisk(disk, 100, 512); err == nil {
+		t.Fatal("should error if not sector aligned")
+	}
+	if _, err := NewPartitionDisk(disk, 4*512, 5*512); err == nil {
+		t.Fatal("should error if beyond the device")
+	}
+
+	part, err := NewPartitionDisk(disk, 2*512, 4*512)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if part.Len() != 4*512 || part.Offset() != 2*512 {
+		t.Fatalf("bad partition: %d at %d", part.Len(), part.Offset())
+	}
+
+	data := bytes.Repeat([]byte{0xAA}, 512)
+	if _, err := part.WriteAt(data, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if disk.Data[2*512] != 0xAA || disk.Data[2*512-1] != 0 {
+		t.Fatal("write not at the partition offset")
+	}
+	if _, err := part.WriteAt(data, 4*512-1); err == nil {
+		t.Fatal("should error writing beyond the partition")
+	}
+
+	buf := make([]byte, 1024)
+	n, err := part.ReadAt(buf, 3*512)
+	if n != 512 || err != io.EOF {
+		t.Fatalf("expected a short read, got %d: %v", n, err)
+	}
+	if _, err := part.ReadAt(buf, 0); err != nil || buf[0] != 0xAA {
+		t.Fatalf("bad read: %v", err)
+	}
+}